@@ -0,0 +1,162 @@
+//Package accounting counts traffic per prefix, using an iptree Root of Counters, and
+//sums the counts up the hierarchy.
+package accounting
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"iptree"
+)
+
+//Counter counts bytes and packets. It is safe for concurrent use
+type Counter struct {
+	bytes   uint64
+	packets uint64
+}
+
+//Add counts one packet of n bytes
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.bytes, n)
+	atomic.AddUint64(&c.packets, 1)
+}
+
+//Totals returns the current counts
+func (c *Counter) Totals() Totals {
+	return Totals{
+		Bytes:   atomic.LoadUint64(&c.bytes),
+		Packets: atomic.LoadUint64(&c.packets),
+	}
+}
+
+//Totals is a snapshot of a Counter, or the sum of several
+type Totals struct {
+	Bytes   uint64
+	Packets uint64
+}
+
+//Usage is the counts of one prefix, as returned by RollUp
+type Usage struct {
+	Prefix net.IPNet
+	//Depth is the distance from root, as given to a Traverser
+	Depth int
+	//Own is counted at the prefix itself, Total also includes all of its descendants
+	Own   Totals
+	Total Totals
+}
+
+//Tree is a Root with a *Counter for every element. It is safe for concurrent use.
+//Account never takes a lock: Add builds a copy of the Root with the new prefix and then
+//publishes it, so Account always reads a Root that is not being changed.
+type Tree struct {
+	//mu serializes Add
+	mu sync.Mutex
+	//root holds a published, holding the current Root
+	root atomic.Value
+}
+
+//published wraps the current Root, so atomic.Value always holds the same type
+type published struct {
+	iptree.Root
+}
+
+//New returns a Tree for prefixes of iplen, with a counter for everything at root
+func New(iplen int) *Tree {
+	t := &Tree{}
+	t.root.Store(published{iptree.NewDefaultRoot(iplen, &Counter{})})
+	return t
+}
+
+//Add adds a Counter at ipnet, if there isn't one already. Copying the Root takes time in
+//proportion to its size, so add prefixes in bulk before counting where possible.
+//Counts already made are kept, as the copy shares every existing Counter
+func (t *Tree) Add(ipnet net.IPNet) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	root := t.Root()
+	if value, err := root.Find(ipnet, false); err == nil {
+		if _, ok := value.(*Counter); ok {
+			return nil
+		}
+	}
+	tx := iptree.Begin(root)
+	if err := tx.Insert(ipnet, &Counter{}); err != nil {
+		return err
+	}
+	root, err := tx.Commit()
+	if err != nil {
+		return err
+	}
+	t.root.Store(published{root})
+	return nil
+}
+
+//Root returns the current Root, to serialize or inspect. Its values are *Counter.
+//It must not be changed; use Add instead
+func (t *Tree) Root() iptree.Root {
+	return t.root.Load().(published).Root
+}
+
+//Account counts one packet of n bytes against the most specific prefix containing ip
+func (t *Tree) Account(ip net.IP, n uint64) error {
+	c, err := t.counter(ip)
+	if err != nil {
+		return err
+	}
+	c.Add(n)
+	return nil
+}
+
+func (t *Tree) counter(ip net.IP) (*Counter, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	root := t.Root()
+	iplen := root.GetIPLength()
+	if len(ip) != iplen {
+		return nil, iptree.ErrWrongIPLength
+	}
+	value, err := root.Find(net.IPNet{IP: ip, Mask: net.CIDRMask(iplen*8, iplen*8)}, true)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := value.(*Counter)
+	if !ok {
+		return nil, iptree.ErrValueType
+	}
+	return c, nil
+}
+
+//RollUp returns the usage of every prefix in traversal order, with totals including descendants.
+//Counters keep counting while RollUp runs, so the result is not an exact snapshot.
+func (t *Tree) RollUp() ([]Usage, error) {
+	var usage []Usage
+	if err := t.Root().Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+		c, ok := value.(*Counter)
+		if !ok {
+			return iptree.ErrValueType
+		}
+		own := c.Totals()
+		usage = append(usage, Usage{Prefix: ipnet, Depth: distance, Own: own, Total: own})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	//Walk backwards, so every descendant is complete before it is added to its parent
+	var stack []int
+	for i := len(usage) - 1; i >= 0; i-- {
+		for len(stack) > 0 && usage[stack[len(stack)-1]].Depth > usage[i].Depth {
+			child := usage[stack[len(stack)-1]]
+			stack = stack[:len(stack)-1]
+			if child.Depth == usage[i].Depth+1 {
+				usage[i].Total.Bytes += child.Total.Bytes
+				usage[i].Total.Packets += child.Total.Packets
+			}
+		}
+		stack = append(stack, i)
+	}
+	return usage, nil
+}
@@ -0,0 +1,120 @@
+package accounting_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"iptree"
+	"iptree/accounting"
+)
+
+func TestRollUp(t *testing.T) {
+	tree := accounting.New(net.IPv4len)
+	for _, s := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24", "10.2.0.0/16", "192.168.0.0/16"} {
+		_, ipnet, _ := net.ParseCIDR(s)
+		if err := tree.Add(*ipnet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//Count from several goroutines at once
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				for ip, n := range map[string]uint64{
+					"10.1.1.1":    100,
+					"10.1.2.2":    10,
+					"10.2.0.1":    1,
+					"10.3.0.1":    1000,
+					"192.168.0.1": 5,
+					"8.8.8.8":     2,
+				} {
+					if err := tree.Account(net.ParseIP(ip), n); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	usage, err := tree.RollUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := ""
+	for _, u := range usage {
+		got += fmt.Sprintf("%v%v: %v/%v %v/%v\n", strings.Repeat(" ", u.Depth), u.Prefix.String(),
+			u.Own.Bytes, u.Own.Packets, u.Total.Bytes, u.Total.Packets)
+	}
+	want := `0.0.0.0/0: 800/400 447200/2400
+ 10.0.0.0/8: 400000/400 444400/1600
+  10.1.0.0/16: 4000/400 44000/800
+   10.1.1.0/24: 40000/400 40000/400
+  10.2.0.0/16: 400/400 400/400
+ 192.168.0.0/16: 2000/400 2000/400
+`
+	if got != want {
+		t.Error(got)
+	}
+
+	//Wrong IP length and value type (expect errors)
+	if err := tree.Account(net.ParseIP("2001:db8::1"), 1); err != iptree.ErrWrongIPLength {
+		t.Error(err)
+	}
+	_, ipnet, _ := net.ParseCIDR("172.16.0.0/12")
+	if err := tree.Root().Insert(*ipnet, "not a counter"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Account(net.ParseIP("172.16.0.1"), 1); err != iptree.ErrValueType {
+		t.Error(err)
+	}
+}
+
+func TestAddWhileAccounting(t *testing.T) {
+	tree := accounting.New(net.IPv4len)
+
+	//Count while prefixes are added, run with -race
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if err := tree.Account(net.IPv4(10, byte(g), byte(i), 1), 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	go func() {
+		defer close(stop)
+		for i := 0; i < 256; i++ {
+			ipnet := net.IPNet{IP: net.IPv4(10, byte(i%4), byte(i), 0).To4(), Mask: net.CIDRMask(24, 32)}
+			if err := tree.Add(ipnet); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	<-stop
+
+	//Every packet is counted once, wherever it landed
+	usage, err := tree.RollUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 257 || usage[0].Total.Packets != 4000 {
+		t.Errorf("Prefixes: %v, packets: %v", len(usage), usage[0].Total.Packets)
+	}
+}
@@ -1,6 +1,7 @@
 package iptree
 
 import (
+	"encoding/csv"
 	"io"
 	"net"
 )
@@ -11,6 +12,15 @@ import (
 //If any (non-nil) error is returned, Root.Traverse() will terminate.
 type Traverser func(ipnet net.IPNet, value interface{}, distance int) error
 
+//An Updater is passed to Update().
+//It receives the current value and whether the element exists, and returns the new value
+//and whether to keep the element. Returning false for keep removes an existing element.
+type Updater func(value interface{}, exists bool) (newValue interface{}, keep bool)
+
+//A Predicate is passed to RemoveIf().
+//It must accept an IPNet and a generic value, and return true if the element should be removed.
+type Predicate func(ipnet net.IPNet, value interface{}) bool
+
 //A ValueSerializer must accept an empty interface and return a slice of bytes or an error.
 type ValueSerializer func(value interface{}) (vbytes []byte, e error)
 
@@ -29,7 +39,8 @@ type Root interface {
 	//Insert inserts or overwrites an element into the tree
 	Insert(net.IPNet, interface{}) error
 
-	//Remove deletes an element at IPNet
+	//Remove deletes an element at IPNet, along with everything beneath it.
+	//If the root is removed, returns ErrRemovedRoot containing its children
 	Remove(net.IPNet) error
 
 	//Traverse calls the passed-in function for every element.
@@ -43,6 +54,36 @@ type Root interface {
 	Count() int
 }
 
+//MatchFinder is implemented by a Root that can report which element a Find returned.
+//Every Root returned by this package implements it. See FindMatch.
+type MatchFinder interface {
+	FindMatch(ipnet net.IPNet, allowSupernet bool) (net.IPNet, interface{}, error)
+}
+
+//Updatable is implemented by a Root that can find or create an element in a single search.
+//Every Root returned by this package implements it. See Update.
+type Updatable interface {
+	Update(net.IPNet, Updater) error
+}
+
+//SubtreeRemover is implemented by a Root that can remove a subtree itself.
+//Every Root returned by this package implements it. See RemoveSubtree.
+type SubtreeRemover interface {
+	RemoveSubtree(net.IPNet) error
+}
+
+//ConditionalRemover is implemented by a Root that can remove elements matching a Predicate
+//in a single walk. Every Root returned by this package implements it. See RemoveIf.
+type ConditionalRemover interface {
+	RemoveIf(Predicate) error
+}
+
+//Pruner is implemented by a Root that can prune itself.
+//Every Root returned by this package implements it. See Prune.
+type Pruner interface {
+	Prune(maxDepth int) error
+}
+
 //NewDefaultRoot returns a new Root element of all zeros (ie, 0.0.0.0/0 if length is 4)
 func NewDefaultRoot(length int, rootValue interface{}) Root {
 	b := make([]byte, length)
@@ -58,11 +99,69 @@ func NewRoot(ipnet net.IPNet, rootValue interface{}) Root {
 	return makeNode(ipnet, rootValue, nil)
 }
 
+//FindMatch is the same as Root.Find, but also returns the IPNet of the element found.
+//With allowSupernet, this is the most specific prefix containing IPNet.
+//If root does not implement MatchFinder, each shorter prefix of IPNet is tried in turn
+//with Find, so IPNet must have a canonical mask.
+func FindMatch(root Root, ipnet net.IPNet, allowSupernet bool) (net.IPNet, interface{}, error) {
+	return findMatch(root, ipnet, allowSupernet)
+}
+
+//Update finds or creates the element at IPNet, and sets its value to the one returned by
+//the Updater, or removes it if keep is false. Unlike Remove, removing an element this way
+//moves its children up to its parent. New roots are handled the same as by Insert.
+//If root implements Updatable, this takes a single search of the tree and the Updater is not
+//called when IPNet cannot be inserted. Otherwise the element is found with Find and then
+//changed with Insert or Remove, and any error from those is returned after the Updater is called.
+func Update(root Root, ipnet net.IPNet, f Updater) error {
+	return update(root, ipnet, f)
+}
+
+//RemoveSubtree deletes an element at IPNet along with all of its descendants.
+//If the root is removed, returns ErrRemovedRoot with no new roots.
+//If root does not implement SubtreeRemover, Remove is used.
+func RemoveSubtree(root Root, ipnet net.IPNet) error {
+	return removeSubtree(root, ipnet)
+}
+
+//RemoveIf deletes every element for which the Predicate returns true.
+//The Predicate is called for every element in the same order as Traverse. Unlike Remove,
+//only matching elements are deleted; the children of each are moved up to its parent.
+//If the root is removed, returns ErrRemovedRoot containing its remaining children.
+//If root implements ConditionalRemover this takes a single walk of the tree. Otherwise the
+//matches are found with Traverse and removed one at a time, as with Update.
+func RemoveIf(root Root, pred Predicate) error {
+	return removeIf(root, pred)
+}
+
+//Prune deletes every element further than maxDepth from root. Prune(root, 0) leaves only root.
+//If maxDepth is negative, nothing remains and it returns ErrRemovedRoot with no new roots.
+//If root does not implement Pruner, the elements to remove are found with Traverse.
+func Prune(root Root, maxDepth int) error {
+	return prune(root, maxDepth)
+}
+
 //Serialize writes the bytes representing the entire tree.
 //It will write the bytes to out. The passed-in ValueSeralizer must be able
 //to serialize every value in the tree.
 func Serialize(root Root, out io.Writer, serializer ValueSerializer) error {
-	return serialize(root, out, serializer)
+	return serialize(root, out, serializer, SerializeOptions{})
+}
+
+//SerializeOptions changes how SerializeWithOptions writes a tree.
+//Deserialize and DecodeStream detect the options used, so they need none of their own.
+type SerializeOptions struct {
+	//DeltaIP writes each element's mask as a prefix length, and its IP without the
+	//leading bytes it shares with its parent. Every mask in the tree must be canonical.
+	DeltaIP bool
+
+	//Gzip compresses the whole stream with compress/gzip
+	Gzip bool
+}
+
+//SerializeWithOptions is the same as Serialize, with the size-reducing options in opts
+func SerializeWithOptions(root Root, out io.Writer, serializer ValueSerializer, opts SerializeOptions) error {
+	return serialize(root, out, serializer, opts)
 }
 
 //Deserialize reads bytes from in, and rebuilds a previously Serialized tree.
@@ -70,3 +169,71 @@ func Serialize(root Root, out io.Writer, serializer ValueSerializer) error {
 func Deserialize(in io.Reader, deserializer ValueDeserializer) (Root, error) {
 	return deserialize(in, deserializer)
 }
+
+//DecodeStream reads bytes from in, as written by Serialize, and calls f for every
+//element as soon as it is read, without building a tree. Elements are passed in
+//the same order and with the same distance as Root.Traverse would produce.
+//If f returns an error at any time, decoding ends and the error is returned.
+//The bytes passed to the ValueDeserializer are reused between elements.
+func DecodeStream(in io.Reader, deserializer ValueDeserializer, f Traverser) error {
+	return decodeStream(in, deserializer, f)
+}
+
+//WriteCompact writes the entire tree to out in a read-only, offset-based format
+//that can be queried in place with NewCompactTree or OpenCompactTree.
+//The passed-in ValueSerializer must be able to serialize every value in the tree.
+func WriteCompact(root Root, out io.Writer, serializer ValueSerializer) error {
+	return writeCompact(root, out, serializer)
+}
+
+//NewCompactTree returns a CompactTree reading from data, as written by WriteCompact.
+//data is used in place and must not be modified while the tree is in use.
+func NewCompactTree(data []byte) (*CompactTree, error) {
+	return newCompactTree(data, nil)
+}
+
+//OpenCompactTree memory-maps the file at path, as written by WriteCompact, and returns
+//a CompactTree reading from it. The caller must Close the tree to unmap the file.
+func OpenCompactTree(path string) (*CompactTree, error) {
+	data, closer, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newCompactTree(data, closer)
+	if err != nil && closer != nil {
+		closer()
+	}
+	return t, err
+}
+
+//ImportCSV reads records from r and inserts them into root. Each record holds either a CIDR
+//prefix or a start and end address, which is inserted as the fewest prefixes covering the range.
+//Range addresses must be IPv4 text for an IPv4 tree and IPv6 text for an IPv6 tree.
+//parseValue is passed the value column (or "" if there is none) and returns the value to insert;
+//if it is nil, the column is inserted as a string. Set r.Comma to '\t' for TSV.
+//Records that cannot be parsed or inserted are skipped and reported in an ErrCSVImport.
+//The returned Root is the new root if any insertion caused one, otherwise it is root.
+func ImportCSV(root Root, r *csv.Reader, columns CSVColumns, parseValue func(string) (interface{}, error)) (Root, error) {
+	return importCSV(root, r, columns, parseValue)
+}
+
+//ExportCSV writes a header and then one record per element to w, in traversal order.
+//Each record holds the prefix, the value as returned from formatValue, the distance from root
+//and the parent's prefix (empty for root). If formatValue is nil, values are formatted with fmt.Sprint.
+func ExportCSV(root Root, w *csv.Writer, formatValue func(interface{}) (string, error)) error {
+	return exportCSV(root, w, formatValue)
+}
+
+//Replay rebuilds a tree by deserializing snapshot, as written by Serialize, and then
+//applying every record in log, as written by a MutationLog. If the log removed the
+//root, Replay stops and returns ErrRemovedRoot.
+func Replay(snapshot io.Reader, log io.Reader, deserializer ValueDeserializer) (Root, error) {
+	root, err := deserialize(snapshot, deserializer)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		return nil, ErrInvalidData
+	}
+	return replayLog(root, log, deserializer)
+}
@@ -456,3 +456,255 @@ func TestFind(t *testing.T) {
 	}
 
 }
+
+func TestUpdate(t *testing.T) {
+	tree := iptree.NewRoot(net.IPNet{
+		IP:   []byte{10, 0, 0, 0},
+		Mask: []byte{255, 0, 0, 0},
+	}, 0)
+
+	counter := func(value interface{}, exists bool) (interface{}, bool) {
+		if !exists {
+			return 1, true
+		}
+		return value.(int) + 1, true
+	}
+
+	//Count 10.1.0.0/16 three times
+	ipnet := net.IPNet{
+		IP:   []byte{10, 1, 0, 0},
+		Mask: []byte{255, 255, 0, 0},
+	}
+	for i := 0; i < 3; i++ {
+		if err := iptree.Update(tree, ipnet, counter); err != nil {
+			t.Error(err)
+		}
+	}
+	v, err := tree.Find(ipnet, false)
+	if err != nil || v.(int) != 3 {
+		t.Errorf("Error: %v, v: %v", err, v)
+	}
+
+	//Delete by returning false
+	err = iptree.Update(tree, ipnet, func(value interface{}, exists bool) (interface{}, bool) {
+		if !exists || value.(int) != 3 {
+			t.Errorf("exists: %v, value: %v", exists, value)
+		}
+		return nil, false
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if v, err := tree.Find(ipnet, false); err != iptree.ErrNotFound {
+		t.Errorf("Error: %v, v: %v", err, v)
+	}
+	if c := tree.Count(); c != 1 {
+		t.Errorf("Got count of %v", c)
+	}
+
+	//Returning false for a missing element inserts nothing
+	err = iptree.Update(tree, ipnet, func(value interface{}, exists bool) (interface{}, bool) {
+		return 1, false
+	})
+	if err != nil || tree.Count() != 1 {
+		t.Errorf("Error: %v, count: %v", err, tree.Count())
+	}
+
+	//Outside the tree, the Updater is not called (expect error)
+	err = iptree.Update(tree, net.IPNet{
+		IP:   []byte{192, 168, 0, 0},
+		Mask: []byte{255, 255, 0, 0},
+	}, func(value interface{}, exists bool) (interface{}, bool) {
+		t.Error("Updater called")
+		return nil, true
+	})
+	if err != iptree.ErrNotFound {
+		t.Error(err)
+	}
+
+	//New root
+	err = iptree.Update(tree, net.IPNet{
+		IP:   []byte{0, 0, 0, 0},
+		Mask: []byte{0, 0, 0, 0},
+	}, counter)
+	if reflect.TypeOf(err) != reflect.TypeOf(iptree.ErrNewRoot{}) {
+		t.Error(err)
+	}
+
+	//A Root without an Update method is updated with Find, Insert and Remove
+	plain := plainRoot{buildStreamTree(t)}
+	_, ten, _ := net.ParseCIDR("10.0.0.0/8")
+	_, ten3, _ := net.ParseCIDR("10.3.0.0/16")
+	for i := 0; i < 2; i++ {
+		if err := iptree.Update(plain, *ten3, counter); err != nil {
+			t.Error(err)
+		}
+	}
+	if v, err := plain.Find(*ten3, false); err != nil || v.(int) != 2 {
+		t.Errorf("Error: %v, v: %v", err, v)
+	}
+	err = iptree.Update(plain, *ten, func(interface{}, bool) (interface{}, bool) {
+		return nil, false
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	want := "0.0.0.0/0: default\n 10.1.0.0/16: 10.1.0.0/16\n  10.1.1.0/24: 10.1.1.0/24\n   10.1.1.128/25: 10.1.1.128/25\n 10.2.0.0/16: 10.2.0.0/16\n 10.3.0.0/16: 2\n 192.168.0.0/16: 192.168.0.0/16\n"
+	if s, _ := traverseString(plain); s != want {
+		t.Error(s)
+	}
+}
+
+//plainRoot hides every method of a Root except those in the Root interface
+type plainRoot struct {
+	iptree.Root
+}
+
+func TestRemoveSubtree(t *testing.T) {
+	build := func() iptree.Root {
+		tree := iptree.NewDefaultRoot(net.IPv4len, "default")
+		for _, s := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24", "10.2.0.0/16", "11.0.0.0/8"} {
+			_, ipnet, _ := net.ParseCIDR(s)
+			if err := tree.Insert(*ipnet, s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tree
+	}
+	tstring := func(tree iptree.Root) string {
+		s := ""
+		tree.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+			s += fmt.Sprintf("%v%v\n", strings.Repeat(" ", distance), ipnet.String())
+			return nil
+		})
+		return s
+	}
+	_, ten, _ := net.ParseCIDR("10.0.0.0/8")
+
+	//Remove drops everything beneath the element
+	tree := build()
+	if err := tree.Remove(*ten); err != nil {
+		t.Error(err)
+	}
+	if s := tstring(tree); s != "0.0.0.0/0\n 11.0.0.0/8\n" {
+		t.Error(s)
+	}
+
+	//Removing with Update moves children up to the parent
+	tree = build()
+	err := iptree.Update(tree, *ten, func(interface{}, bool) (interface{}, bool) {
+		return nil, false
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if s := tstring(tree); s != "0.0.0.0/0\n 10.1.0.0/16\n  10.1.1.0/24\n 10.2.0.0/16\n 11.0.0.0/8\n" {
+		t.Error(s)
+	}
+
+	//RemoveSubtree drops children too
+	tree = build()
+	if err := iptree.RemoveSubtree(tree, *ten); err != nil {
+		t.Error(err)
+	}
+	if s := tstring(tree); s != "0.0.0.0/0\n 11.0.0.0/8\n" {
+		t.Error(s)
+	}
+
+	//RemoveSubtree of root (expect ErrRemovedRoot with no new roots)
+	err = iptree.RemoveSubtree(tree, net.IPNet{
+		IP:   []byte{0, 0, 0, 0},
+		Mask: []byte{0, 0, 0, 0},
+	})
+	if rr, ok := err.(iptree.ErrRemovedRoot); !ok || len(rr.NewRoots) != 0 {
+		t.Error(err)
+	}
+
+	//RemoveIf every /16, in traversal order
+	tree = build()
+	visited := ""
+	err = iptree.RemoveIf(tree, func(ipnet net.IPNet, value interface{}) bool {
+		visited += ipnet.String() + " "
+		ones, _ := ipnet.Mask.Size()
+		return ones == 16
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if visited != "0.0.0.0/0 10.0.0.0/8 10.1.0.0/16 10.1.1.0/24 10.2.0.0/16 11.0.0.0/8 " {
+		t.Error(visited)
+	}
+	if s := tstring(tree); s != "0.0.0.0/0\n 10.0.0.0/8\n  10.1.1.0/24\n 11.0.0.0/8\n" {
+		t.Error(s)
+	}
+
+	//RemoveIf matching root and 10.0.0.0/8 (expect ErrRemovedRoot with what remains)
+	err = iptree.RemoveIf(tree, func(ipnet net.IPNet, value interface{}) bool {
+		ones, _ := ipnet.Mask.Size()
+		return ones < 9
+	})
+	rr, ok := err.(iptree.ErrRemovedRoot)
+	if !ok || len(rr.NewRoots) != 1 || tstring(rr.NewRoots[0]) != "10.1.1.0/24\n" {
+		t.Error(err)
+	}
+
+	//Prune below depth 1
+	tree = build()
+	if err := iptree.Prune(tree, 1); err != nil {
+		t.Error(err)
+	}
+	if s := tstring(tree); s != "0.0.0.0/0\n 10.0.0.0/8\n 11.0.0.0/8\n" {
+		t.Error(s)
+	}
+	if err := iptree.Prune(tree, -1); reflect.TypeOf(err) != reflect.TypeOf(iptree.ErrRemovedRoot{}) {
+		t.Error(err)
+	}
+	//A Root without the optional methods gives the same results
+	plain := plainRoot{build()}
+	if err := iptree.RemoveSubtree(plain, *ten); err != nil {
+		t.Error(err)
+	}
+	if s := tstring(plain); s != "0.0.0.0/0\n 11.0.0.0/8\n" {
+		t.Error(s)
+	}
+	plain = plainRoot{build()}
+	err = iptree.RemoveIf(plain, func(ipnet net.IPNet, value interface{}) bool {
+		ones, _ := ipnet.Mask.Size()
+		return ones == 16 || ones == 8
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if s := tstring(plain); s != "0.0.0.0/0\n 10.1.1.0/24\n" {
+		t.Error(s)
+	}
+	plain = plainRoot{build()}
+	if err := iptree.Prune(plain, 1); err != nil {
+		t.Error(err)
+	}
+	if s := tstring(plain); s != "0.0.0.0/0\n 10.0.0.0/8\n 11.0.0.0/8\n" {
+		t.Error(s)
+	}
+}
+
+func TestFindMatch(t *testing.T) {
+	tree := buildStreamTree(t)
+	_, host, _ := net.ParseCIDR("10.1.1.7/32")
+	_, missing, _ := net.ParseCIDR("10.9.0.0/16")
+
+	//The tree and a Root without a FindMatch method give the same answers
+	for _, root := range []iptree.Root{tree, plainRoot{tree}} {
+		match, v, err := iptree.FindMatch(root, *host, true)
+		if err != nil || match.String() != "10.1.1.0/24" || v != "10.1.1.0/24" {
+			t.Errorf("Error: %v, match: %v, v: %v", err, match.String(), v)
+		}
+		match, v, err = iptree.FindMatch(root, *missing, true)
+		if err != nil || match.String() != "10.0.0.0/8" || v != "10.0.0.0/8" {
+			t.Errorf("Error: %v, match: %v, v: %v", err, match.String(), v)
+		}
+		//Exact match only (expect ErrNotFound)
+		if _, _, err := iptree.FindMatch(root, *missing, false); err != iptree.ErrNotFound {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package iptree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+//Compact format layout, all integers big endian:
+//
+// header:  magic "IPTC", version (1 byte), IP length (1 byte), reserved (2 bytes),
+//          node count (uint32), value region length (uint32)
+// records: one per node, in traversal order. Each is IP, Mask, subtree size (uint32),
+//          value offset (uint32) and value length (uint32)
+// values:  every serialized value, back to back
+//
+//A node's children start directly after it, and the next sibling is found
+//by skipping the node's subtree size, so no pointers need to be followed.
+const (
+	compactMagic      = "IPTC"
+	compactVersion    = 1
+	compactHeaderSize = 16
+)
+
+//CompactTraverser is a type passed to CompactTree.Traverse().
+//It is the same as Traverser, except the value is passed as the raw bytes
+//returned from the ValueSerializer when the tree was written.
+type CompactTraverser func(ipnet net.IPNet, value []byte, distance int) error
+
+//CompactTree is a read-only tree stored in the compact format written by WriteCompact.
+//Lookups are done in place, and returned IPNets and values point directly into the
+//underlying bytes, so they must not be modified or used after Close.
+type CompactTree struct {
+	data   []byte
+	iplen  int
+	count  int
+	values []byte
+	closer func() error
+}
+
+//writeCompact writes root in the compact format
+func writeCompact(root Root, out io.Writer, serializer ValueSerializer) error {
+	iplen := root.GetIPLength()
+	if iplen > 255 {
+		return ErrWrongIPLength
+	}
+	recSize := 2*iplen + 12
+
+	var records, values bytes.Buffer
+	//Subtree sizes are only known once a subtree has been fully traversed,
+	//so keep the start index of each open ancestor and patch the size later
+	var sizes []uint32
+	var open []int
+	closeTo := func(distance int) {
+		for len(open) > distance {
+			start := open[len(open)-1]
+			sizes[start] = uint32(len(sizes) - start)
+			open = open[:len(open)-1]
+		}
+	}
+
+	if err := root.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+		if len(ipnet.IP) != iplen || len(ipnet.Mask) != iplen {
+			return ErrWrongIPLength
+		}
+		closeTo(distance)
+		open = append(open, len(sizes))
+		sizes = append(sizes, 0)
+
+		vbuf, err := serializer(value)
+		if err != nil {
+			return err
+		}
+
+		var tail [12]byte
+		binary.BigEndian.PutUint32(tail[4:], uint32(values.Len()))
+		binary.BigEndian.PutUint32(tail[8:], uint32(len(vbuf)))
+		records.Write(ipnet.IP)
+		records.Write(ipnet.Mask)
+		records.Write(tail[:]) //Size is patched in below
+		values.Write(vbuf)
+		return nil
+	}); err != nil {
+		return err
+	}
+	closeTo(0)
+
+	//Patch subtree sizes
+	rbuf := records.Bytes()
+	for i, size := range sizes {
+		binary.BigEndian.PutUint32(rbuf[i*recSize+2*iplen:], size)
+	}
+
+	var header [compactHeaderSize]byte
+	copy(header[:], compactMagic)
+	header[4] = compactVersion
+	header[5] = byte(iplen)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(sizes)))
+	binary.BigEndian.PutUint32(header[12:], uint32(values.Len()))
+
+	if _, err := out.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := out.Write(rbuf); err != nil {
+		return err
+	}
+	_, err := out.Write(values.Bytes())
+	return err
+}
+
+//newCompactTree checks the header of data and returns a tree that reads from it
+func newCompactTree(data []byte, closer func() error) (*CompactTree, error) {
+	if len(data) < compactHeaderSize || string(data[:4]) != compactMagic || data[4] != compactVersion {
+		return nil, ErrInvalidData
+	}
+	iplen := int(data[5])
+	count := int(binary.BigEndian.Uint32(data[8:]))
+	vlen := int(binary.BigEndian.Uint32(data[12:]))
+
+	recEnd := compactHeaderSize + count*(2*iplen+12)
+	if iplen == 0 || count == 0 || recEnd < compactHeaderSize || len(data)-recEnd < vlen {
+		return nil, ErrInvalidData
+	}
+
+	return &CompactTree{
+		data:   data,
+		iplen:  iplen,
+		count:  count,
+		values: data[recEnd : recEnd+vlen],
+		closer: closer,
+	}, nil
+}
+
+//record returns the IPNet, subtree size and value of the node at index i
+func (t *CompactTree) record(i int) (ipnet net.IPNet, size int, value []byte, err error) {
+	off := compactHeaderSize + i*(2*t.iplen+12)
+	rec := t.data[off : off+2*t.iplen+12]
+
+	ipnet.IP = net.IP(rec[:t.iplen:t.iplen])
+	ipnet.Mask = net.IPMask(rec[t.iplen : 2*t.iplen : 2*t.iplen])
+	size = int(binary.BigEndian.Uint32(rec[2*t.iplen:]))
+	voff := int(binary.BigEndian.Uint32(rec[2*t.iplen+4:]))
+	vlen := int(binary.BigEndian.Uint32(rec[2*t.iplen+8:]))
+
+	if size < 1 || size > t.count-i || voff > len(t.values) || vlen > len(t.values)-voff {
+		return ipnet, 0, nil, ErrInvalidData
+	}
+	return ipnet, size, t.values[voff : voff+vlen : voff+vlen], nil
+}
+
+//Find an element at IPNet, with the same matching rules as Root.Find.
+//The returned value is the bytes written by the ValueSerializer.
+func (t *CompactTree) Find(ipnet net.IPNet, allowSupernet bool) ([]byte, error) {
+	if len(ipnet.IP) != t.iplen {
+		return nil, ErrWrongIPLength
+	}
+
+	i := 0
+	n, size, value, err := t.record(i)
+	if err != nil {
+		return nil, err
+	}
+	if !onPath(n, ipnet) {
+		return nil, ErrNotFound
+	}
+
+	for {
+		if compareMask(n.Mask, ipnet.Mask) == 0 { //Exact match
+			return value, nil
+		}
+
+		//I contain it, so one of my children might find it
+		found := false
+		for c := i + 1; c < i+size; {
+			cn, csize, cvalue, err := t.record(c)
+			if err != nil {
+				return nil, err
+			}
+			if onPath(cn, ipnet) {
+				i, n, size, value = c, cn, csize, cvalue
+				found = true
+				break
+			}
+			c += csize
+		}
+
+		if !found {
+			break
+		}
+	}
+
+	//No children found it, so return the closest supernet if allowed
+	if allowSupernet {
+		return value, nil
+	}
+	return nil, ErrNotFound
+}
+
+//Traverse calls the passed-in function for every element, in the same order as Root.Traverse.
+//If the CompactTraverser function returns an error at any time, execution ends and the error is returned
+func (t *CompactTree) Traverse(f CompactTraverser) error {
+	//End index of every open ancestor
+	ends := make([]int, 0, 10)
+	for i := 0; i < t.count; i++ {
+		ipnet, size, value, err := t.record(i)
+		if err != nil {
+			return err
+		}
+		for len(ends) > 0 && ends[len(ends)-1] <= i {
+			ends = ends[:len(ends)-1]
+		}
+		if len(ends) > 0 && i+size > ends[len(ends)-1] { //Subtree overflows its parent
+			return ErrInvalidData
+		}
+		if err := f(ipnet, value, len(ends)); err != nil {
+			return err
+		}
+		ends = append(ends, i+size)
+	}
+	return nil
+}
+
+//GetIPLength returns the length of IP Address expected
+func (t *CompactTree) GetIPLength() int {
+	return t.iplen
+}
+
+//Count returns the number of nodes in the tree
+func (t *CompactTree) Count() int {
+	return t.count
+}
+
+//Close releases the underlying bytes, if they were mapped by OpenCompactTree.
+//The tree must not be used after Close.
+func (t *CompactTree) Close() error {
+	if t.closer == nil {
+		return nil
+	}
+	err := t.closer()
+	t.closer = nil
+	t.data, t.values = nil, nil
+	return err
+}
+
+//onPath reports whether n is mark, or a supernet of it
+func onPath(n, mark net.IPNet) bool {
+	maskdiff := compareMask(n.Mask, mark.Mask)
+	if maskdiff == 0 {
+		return sameIP(n.IP, mark.IP)
+	}
+	return maskdiff < 0 && n.Contains(mark.IP)
+}
@@ -0,0 +1,93 @@
+package iptree_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"iptree"
+)
+
+func TestCompactTree(t *testing.T) {
+	tree := buildStreamTree(t)
+
+	want, err := traverseString(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cbuf bytes.Buffer
+	err = iptree.WriteCompact(tree, &cbuf, func(v interface{}) ([]byte, error) {
+		return []byte(v.(string)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "tree.iptc")
+	if err := os.WriteFile(path, cbuf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctree, err := iptree.OpenCompactTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctree.Close()
+
+	if c := ctree.Count(); c != tree.Count() {
+		t.Errorf("Got count of %v", c)
+	}
+
+	//Traverse, expect the same output as the original tree
+	got := ""
+	err = ctree.Traverse(func(ipnet net.IPNet, value []byte, distance int) error {
+		got += fmt.Sprintf("%v%v: %v\n", strings.Repeat(" ", distance), ipnet.String(), string(value))
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if got != want {
+		t.Error(got)
+	}
+
+	for _, c := range []struct {
+		cidr          string
+		allowSupernet bool
+		value         string
+		err           error
+	}{
+		{"10.1.1.200/32", true, "10.1.1.128/25", nil},
+		{"10.1.1.5/32", true, "10.1.1.0/24", nil},
+		{"10.1.0.0/16", false, "10.1.0.0/16", nil},
+		{"10.3.0.0/16", true, "10.0.0.0/8", nil},
+		{"10.3.0.0/16", false, "", iptree.ErrNotFound},
+		{"8.8.8.8/32", true, "default", nil},
+		{"192.168.4.0/24", true, "192.168.0.0/16", nil},
+	} {
+		_, ipnet, _ := net.ParseCIDR(c.cidr)
+		v, err := ctree.Find(*ipnet, c.allowSupernet)
+		if err != c.err || string(v) != c.value {
+			t.Errorf("Find %v: error: %v, v: %s", c.cidr, err, v)
+		}
+	}
+
+	//Find with bad IP Length (expect error)
+	v, err := ctree.Find(net.IPNet{
+		IP:   []byte{1, 2, 3, 4, 5},
+		Mask: []byte{255, 255, 255, 255, 255},
+	}, true)
+	if v != nil || err != iptree.ErrWrongIPLength {
+		t.Errorf("Error: %v, v: %v", err, v)
+	}
+
+	//Truncated data (expect error)
+	if _, err := iptree.NewCompactTree(cbuf.Bytes()[:20]); err != iptree.ErrInvalidData {
+		t.Error(err)
+	}
+}
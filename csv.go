@@ -0,0 +1,186 @@
+package iptree
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+//CSVColumns describes where ImportCSV finds each field of a record.
+//Columns are zero based, and -1 means the field is not present.
+//Either Prefix, or both Start and End, must be present. If all three are,
+//records with an empty prefix use the range instead.
+type CSVColumns struct {
+	Prefix int //CIDR prefix, such as 192.168.0.0/16
+	Start  int //First address of a range
+	End    int //Last address of a range, inclusive
+	Value  int //Passed to parseValue
+
+	//Header skips the first record
+	Header bool
+}
+
+//CSVLineError is an error for a single record of a CSV import
+type CSVLineError struct {
+	Line int
+	Err  error
+}
+
+func (e CSVLineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+//ErrCSVImport indicates some records could not be imported. Every other record was still inserted.
+type ErrCSVImport struct {
+	Lines []CSVLineError
+}
+
+func (ErrCSVImport) Error() string {
+	return "Some CSV records could not be imported"
+}
+
+func importCSV(root Root, r *csv.Reader, columns CSVColumns, parseValue func(string) (interface{}, error)) (Root, error) {
+	iplen := root.GetIPLength()
+	var lineErrs []CSVLineError
+	first := true
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		//A header that cannot be parsed is still the header
+		header := first && columns.Header
+		first = false
+		if perr, ok := err.(*csv.ParseError); ok { //Bad record, but the reader can carry on
+			lineErrs = append(lineErrs, CSVLineError{perr.StartLine, perr.Err})
+			continue
+		} else if err != nil {
+			return root, err
+		}
+		if header {
+			continue
+		}
+		line, _ := r.FieldPos(0)
+
+		nets, value, err := parseCSVRecord(record, iplen, columns, parseValue)
+		if err != nil {
+			lineErrs = append(lineErrs, CSVLineError{line, err})
+			continue
+		}
+
+		for _, ipnet := range nets {
+			err := root.Insert(ipnet, value)
+			if nr, ok := err.(ErrNewRoot); ok {
+				root = nr.NewRoot
+			} else if err != nil {
+				lineErrs = append(lineErrs, CSVLineError{line, err})
+				break
+			}
+		}
+	}
+
+	if len(lineErrs) > 0 {
+		return root, ErrCSVImport{lineErrs}
+	}
+	return root, nil
+}
+
+//parseCSVRecord returns the prefixes covered by record, and its value
+func parseCSVRecord(record []string, iplen int, columns CSVColumns, parseValue func(string) (interface{}, error)) ([]net.IPNet, interface{}, error) {
+	field := func(col int) (string, error) {
+		if col < 0 || col >= len(record) {
+			return "", fmt.Errorf("missing column %d", col)
+		}
+		return record[col], nil
+	}
+
+	//A record may leave the prefix empty to use the range columns instead
+	prefix := ""
+	if columns.Prefix >= 0 {
+		var err error
+		if prefix, err = field(columns.Prefix); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var nets []net.IPNet
+	if prefix != "" || columns.Start < 0 {
+		ipnet, err := parseCIDR(prefix)
+		if err != nil {
+			return nil, nil, err
+		}
+		nets = []net.IPNet{ipnet}
+	} else {
+		s, err := field(columns.Start)
+		if err != nil {
+			return nil, nil, err
+		}
+		e, err := field(columns.End)
+		if err != nil {
+			return nil, nil, err
+		}
+		start, end := parseIP(s, iplen), parseIP(e, iplen)
+		if start == nil || end == nil {
+			return nil, nil, ErrInvalidAddress
+		}
+		if compareIP(start, end) > 0 {
+			return nil, nil, ErrInvalidRange
+		}
+		nets = rangeToNets(start, end)
+	}
+
+	var value interface{}
+	s := ""
+	if columns.Value >= 0 {
+		var err error
+		if s, err = field(columns.Value); err != nil {
+			return nil, nil, err
+		}
+		value = s
+	}
+	if parseValue != nil {
+		var err error
+		if value, err = parseValue(s); err != nil {
+			return nil, nil, err
+		}
+	}
+	return nets, value, nil
+}
+
+func exportCSV(root Root, w *csv.Writer, formatValue func(interface{}) (string, error)) error {
+	if err := w.Write([]string{"prefix", "value", "depth", "parent"}); err != nil {
+		return err
+	}
+
+	//parents[d] is the most recent prefix seen at distance d
+	parents := make([]string, 0, 10)
+
+	if err := root.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+		prefix := ipnet.String()
+		parents = append(parents[:distance], prefix)
+		parent := ""
+		if distance > 0 {
+			parent = parents[distance-1]
+		}
+
+		var v string
+		if formatValue != nil {
+			var err error
+			if v, err = formatValue(value); err != nil {
+				return err
+			}
+		} else if value != nil {
+			v = fmt.Sprint(value)
+		}
+
+		return w.Write([]string{prefix, v, strconv.Itoa(distance), parent})
+	}); err != nil {
+		return err
+	}
+
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,203 @@
+package iptree_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"iptree"
+)
+
+func TestImportCSV(t *testing.T) {
+	prefixCols := iptree.CSVColumns{Prefix: 0, Start: -1, End: -1, Value: 1}
+	rangeCols := iptree.CSVColumns{Prefix: -1, Start: 0, End: 1, Value: 2}
+
+	for _, c := range []struct {
+		name    string
+		iplen   int
+		columns iptree.CSVColumns
+		in      string
+		want    string
+		errs    []int //Lines reported in ErrCSVImport
+	}{
+		{
+			name:    "prefixes",
+			iplen:   net.IPv4len,
+			columns: prefixCols,
+			in:      "10.0.0.0/8,a\n10.1.0.0/16,b\n",
+			want:    "0.0.0.0/0: default\n 10.0.0.0/8: a\n  10.1.0.0/16: b\n",
+		},
+		{
+			name:    "header",
+			iplen:   net.IPv4len,
+			columns: iptree.CSVColumns{Prefix: 0, Start: -1, End: -1, Value: 1, Header: true},
+			in:      "prefix,value\n10.0.0.0/8,a\n",
+			want:    "0.0.0.0/0: default\n 10.0.0.0/8: a\n",
+		},
+		{
+			//The bad header is reported, and the next record is still imported
+			name:    "unparseable header",
+			iplen:   net.IPv4len,
+			columns: iptree.CSVColumns{Prefix: 0, Start: -1, End: -1, Value: 1, Header: true},
+			in:      "pre\"fix,value\n10.0.0.0/8,a\n",
+			want:    "0.0.0.0/0: default\n 10.0.0.0/8: a\n",
+			errs:    []int{1},
+		},
+		{
+			name:    "bad records",
+			iplen:   net.IPv4len,
+			columns: prefixCols,
+			in:      "10.0.0.0/33,a\n10.0.0.0/8\n192.168.0.0/16,b\n",
+			want:    "0.0.0.0/0: default\n 192.168.0.0/16: b\n",
+			errs:    []int{1, 2},
+		},
+		{
+			name:    "aligned range",
+			iplen:   net.IPv4len,
+			columns: rangeCols,
+			in:      "10.0.0.0,10.0.255.255,a\n",
+			want:    "0.0.0.0/0: default\n 10.0.0.0/16: a\n",
+		},
+		{
+			name:    "unaligned range",
+			iplen:   net.IPv4len,
+			columns: rangeCols,
+			in:      "10.0.0.1,10.0.0.6,a\n",
+			want:    "0.0.0.0/0: default\n 10.0.0.1/32: a\n 10.0.0.2/31: a\n 10.0.0.4/31: a\n 10.0.0.6/32: a\n",
+		},
+		{
+			name:    "range across a byte",
+			iplen:   net.IPv4len,
+			columns: rangeCols,
+			in:      "10.0.0.255,10.0.1.0,a\n",
+			want:    "0.0.0.0/0: default\n 10.0.0.255/32: a\n 10.0.1.0/32: a\n",
+		},
+		{
+			name:    "single address",
+			iplen:   net.IPv4len,
+			columns: rangeCols,
+			in:      "10.0.0.7,10.0.0.7,a\n",
+			want:    "0.0.0.0/0: default\n 10.0.0.7/32: a\n",
+		},
+		{
+			name:    "full IPv4 space",
+			iplen:   net.IPv4len,
+			columns: rangeCols,
+			in:      "0.0.0.0,255.255.255.255,all\n",
+			want:    "0.0.0.0/0: all\n",
+		},
+		{
+			name:    "full IPv6 space",
+			iplen:   net.IPv6len,
+			columns: rangeCols,
+			in:      "::,ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff,all\n",
+			want:    "::/0: all\n",
+		},
+		{
+			name:    "bad ranges",
+			iplen:   net.IPv4len,
+			columns: rangeCols,
+			in:      "10.0.0.9,10.0.0.1,a\nx,10.0.0.1,a\n::1,::2,a\n",
+			want:    "0.0.0.0/0: default\n",
+			errs:    []int{1, 2, 3},
+		},
+		{
+			//IPv4 text is not taken as IPv4-mapped in an IPv6 tree
+			name:    "IPv4 range in IPv6 tree",
+			iplen:   net.IPv6len,
+			columns: rangeCols,
+			in:      "1.2.3.0,1.2.3.255,a\n2001:db8::,2001:db8::ff,b\n",
+			want:    "::/0: default\n 2001:db8::/120: b\n",
+			errs:    []int{1},
+		},
+	} {
+		r := csv.NewReader(strings.NewReader(c.in))
+		r.FieldsPerRecord = -1
+		root, err := iptree.ImportCSV(iptree.NewDefaultRoot(c.iplen, "default"), r, c.columns, nil)
+
+		var lines []int
+		if ierr, ok := err.(iptree.ErrCSVImport); ok {
+			for _, l := range ierr.Lines {
+				lines = append(lines, l.Line)
+			}
+		} else if err != nil {
+			t.Errorf("Error: %v, case: %v", err, c.name)
+			continue
+		}
+		if !reflect.DeepEqual(lines, c.errs) {
+			t.Errorf("Error: %v, case: %v, lines: %v", err, c.name, lines)
+		}
+		if got, err := traverseString(root); err != nil || got != c.want {
+			t.Errorf("Error: %v, case: %v, got:\n%v", err, c.name, got)
+		}
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		formatValue func(interface{}) (string, error)
+		want        string
+	}{
+		{
+			name: "default format",
+			want: "prefix,value,depth,parent\n" +
+				"0.0.0.0/0,default,0,\n" +
+				"10.0.0.0/8,10.0.0.0/8,1,0.0.0.0/0\n" +
+				"10.1.0.0/16,10.1.0.0/16,2,10.0.0.0/8\n" +
+				"10.1.1.0/24,10.1.1.0/24,3,10.1.0.0/16\n" +
+				"10.1.1.128/25,10.1.1.128/25,4,10.1.1.0/24\n" +
+				"10.2.0.0/16,10.2.0.0/16,2,10.0.0.0/8\n" +
+				"192.168.0.0/16,192.168.0.0/16,1,0.0.0.0/0\n",
+		},
+		{
+			name: "formatValue",
+			formatValue: func(v interface{}) (string, error) {
+				return fmt.Sprintf("%d", len(v.(string))), nil
+			},
+			want: "prefix,value,depth,parent\n" +
+				"0.0.0.0/0,7,0,\n" +
+				"10.0.0.0/8,10,1,0.0.0.0/0\n" +
+				"10.1.0.0/16,11,2,10.0.0.0/8\n" +
+				"10.1.1.0/24,11,3,10.1.0.0/16\n" +
+				"10.1.1.128/25,13,4,10.1.1.0/24\n" +
+				"10.2.0.0/16,11,2,10.0.0.0/8\n" +
+				"192.168.0.0/16,14,1,0.0.0.0/0\n",
+		},
+	} {
+		var buf bytes.Buffer
+		if err := iptree.ExportCSV(buildStreamTree(t), csv.NewWriter(&buf), c.formatValue); err != nil {
+			t.Errorf("Error: %v, case: %v", err, c.name)
+		}
+		if buf.String() != c.want {
+			t.Errorf("case: %v, got:\n%v", c.name, buf.String())
+		}
+	}
+
+	//An error from formatValue ends the export (expect error)
+	err := iptree.ExportCSV(buildStreamTree(t), csv.NewWriter(&bytes.Buffer{}), func(interface{}) (string, error) {
+		return "", iptree.ErrValueType
+	})
+	if err != iptree.ErrValueType {
+		t.Error(err)
+	}
+
+	//Exported prefixes import back into the same tree
+	var buf bytes.Buffer
+	if err := iptree.ExportCSV(buildStreamTree(t), csv.NewWriter(&buf), nil); err != nil {
+		t.Fatal(err)
+	}
+	root, err := iptree.ImportCSV(iptree.NewDefaultRoot(net.IPv4len, "default"), csv.NewReader(&buf),
+		iptree.CSVColumns{Prefix: 0, Start: -1, End: -1, Value: 1, Header: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := traverseString(buildStreamTree(t))
+	if got, err := traverseString(root); err != nil || got != want {
+		t.Errorf("Error: %v, got:\n%v", err, got)
+	}
+}
@@ -1,6 +1,9 @@
 package iptree
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 //ErrNotImplimented should no longer be used
 //var ErrNotImplimented = errors.New("Not Implimented Yet")
@@ -11,8 +14,43 @@ var ErrWrongIPLength = errors.New("IP length does not match root's IP length")
 //ErrNotFound indicates the requested element was not found in the tree
 var ErrNotFound = errors.New("Could not find element")
 
-//ErrInvalidData is not currently used
-//var ErrInvalidData = errors.New("Invalid data")
+//ErrInvalidAddress indicates a string could not be parsed as an IP address of the expected length
+var ErrInvalidAddress = errors.New("Invalid IP address")
+
+//ErrInvalidRange indicates the start of an address range is greater than its end
+var ErrInvalidRange = errors.New("Range start is greater than range end")
+
+//ErrValueType indicates a value did not have the type a ValueSerializer or ValueDeserializer expected
+var ErrValueType = errors.New("Value has unexpected type")
+
+//ErrNonCanonicalMask indicates a mask with non-contiguous ones, which cannot be written as a prefix length
+var ErrNonCanonicalMask = errors.New("Mask is not in canonical form")
+
+//ErrNoSnapshot indicates a SnapshotStore has no snapshot that could be loaded
+var ErrNoSnapshot = errors.New("No valid snapshot found")
+
+//ErrTxDone indicates a transaction was used after Commit or Rollback
+var ErrTxDone = errors.New("Transaction already committed or rolled back")
+
+//ErrStaleRoot indicates a change to a root that has been replaced, either by a committed
+//transaction or by the new roots returned when its root element was removed
+var ErrStaleRoot = errors.New("Root was replaced")
+
+//ErrRootTTL indicates a TTL was given for the root element, which cannot expire
+var ErrRootTTL = errors.New("Root element cannot have a TTL")
+
+//ErrExpiringRoot indicates a Root whose elements can expire was passed to NewIndexedRoot
+var ErrExpiringRoot = errors.New("Cannot index a Root whose elements expire")
+
+//ErrRemoveLoggedRoot indicates a change to a Root from Attach would remove its root element,
+//after which the log could not be replayed
+var ErrRemoveLoggedRoot = errors.New("Cannot remove the root element of a logged Root")
+
+//ErrValueTooLarge indicates a serialized value is longer than can be written (65535 bytes)
+var ErrValueTooLarge = errors.New("Serialized value too large")
+
+//ErrInvalidData indicates serialized data could not be decoded into a tree
+var ErrInvalidData = errors.New("Invalid data")
 
 //ErrNewRoot indicates an insertion caused a new root element to be created
 type ErrNewRoot struct {
@@ -31,3 +69,23 @@ type ErrRemovedRoot struct {
 func (ErrRemovedRoot) Error() string {
 	return "Root element removed"
 }
+
+//ErrTxFailed indicates a transaction was not committed because one of its operations failed.
+//Op is the index of the failed operation, in the order they were staged.
+type ErrTxFailed struct {
+	Op  int
+	Err error
+}
+
+func (e ErrTxFailed) Error() string {
+	return fmt.Sprintf("Transaction operation %d failed: %v", e.Op, e.Err)
+}
+
+//succeeded reports whether err is nil, or reports a root change from an operation that was applied
+func succeeded(err error) bool {
+	switch err.(type) {
+	case nil, ErrNewRoot, ErrRemovedRoot:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+//Package heavyhitter finds the prefixes responsible for most of a stream of weighted addresses,
+//at any prefix length, using an iptree Root that grows towards heavy traffic and shrinks
+//to stay within a fixed number of elements.
+package heavyhitter
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"iptree"
+)
+
+//Defaults used by New
+const (
+	DefaultStep     = 4
+	DefaultExpand   = 0.01
+	DefaultLowWater = 0.875
+)
+
+//HeavyHitter is a prefix reported by Report
+type HeavyHitter struct {
+	Prefix net.IPNet
+	//Weight counted at the prefix and its descendants, less the weight of descendant heavy hitters
+	Weight uint64
+	//Total weight counted at the prefix and all of its descendants
+	Total uint64
+}
+
+//Detector counts weight per prefix. Weight is counted at the most specific prefix in the tree
+//containing each address, so the counts of a prefix are a lower bound, missing anything
+//ingested before the prefix was added. No weight is ever lost, and collapsed prefixes
+//give their weight to their parents.
+//It is safe for concurrent use.
+type Detector struct {
+	//Budget is the most elements the tree may hold, including root
+	Budget int
+	//Step is how many bits longer a new prefix is than the one it expands
+	Step int
+	//Expand is the fraction of all weight a prefix must have counted itself before it is expanded
+	Expand float64
+	//LowWater is the fraction of Budget the tree is collapsed to once it is full, so the tree
+	//is only walked to find light leaves once every few expansions
+	LowWater float64
+
+	mu    sync.Mutex
+	root  iptree.Root
+	size  int
+	total uint64
+	//floor is a weight no leaf is lighter than, found by the last collapse that removed nothing.
+	//Leaves only get heavier until the next insertion, which resets it.
+	floor uint64
+}
+
+type counter struct {
+	weight uint64
+}
+
+//New returns a Detector for addresses of iplen, with a tree of at most budget elements
+func New(iplen int, budget int) *Detector {
+	return &Detector{
+		Budget:   budget,
+		Step:     DefaultStep,
+		Expand:   DefaultExpand,
+		LowWater: DefaultLowWater,
+		root:     iptree.NewDefaultRoot(iplen, &counter{}),
+		size:     1,
+	}
+}
+
+//Total returns the weight of everything ingested
+func (d *Detector) Total() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.total
+}
+
+//Count returns the number of prefixes in the tree
+func (d *Detector) Count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size
+}
+
+//Ingest counts weight for ip, then expands its prefix towards ip if it has become heavy
+func (d *Detector) Ingest(ip net.IP, weight uint64) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	iplen := d.root.GetIPLength()
+	if len(ip) != iplen {
+		return iptree.ErrWrongIPLength
+	}
+	bits := iplen * 8
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	prefix, value, err := iptree.FindMatch(d.root, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, true)
+	if err != nil {
+		return err
+	}
+	c := value.(*counter)
+	c.weight += weight
+	d.total += weight
+
+	ones, _ := prefix.Mask.Size()
+	if ones == bits || float64(c.weight) < d.Expand*float64(d.total) {
+		return nil
+	}
+	if d.size >= d.Budget && !d.collapse(c.weight) {
+		return nil
+	}
+
+	//Expand towards ip
+	next := ones + d.Step
+	if d.Step < 1 || next > bits {
+		next = bits
+	}
+	mask := net.CIDRMask(next, bits)
+	if err := d.root.Insert(net.IPNet{IP: ip.Mask(mask), Mask: mask}, &counter{}); err != nil {
+		return err
+	}
+	d.size++
+	d.floor = 0
+	return nil
+}
+
+//collapse removes the lightest leaves that are lighter than below, giving their weight to
+//their parents, until the tree is down to LowWater of Budget. Returns whether any leaf was removed
+func (d *Detector) collapse(below uint64) bool {
+	if below <= d.floor {
+		return false
+	}
+
+	type leaf struct {
+		ipnet  net.IPNet
+		c      *counter
+		parent *counter
+	}
+	var leaves []leaf
+	var ancestors []*counter
+	lastDepth := 0
+	d.root.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+		//The previous element is not a leaf if this one is beneath it
+		if distance > lastDepth && lastDepth > 0 {
+			leaves = leaves[:len(leaves)-1]
+		}
+		c := value.(*counter)
+		if distance > 0 {
+			leaves = append(leaves, leaf{ipnet, c, ancestors[distance-1]})
+		}
+		ancestors = append(ancestors[:distance], c)
+		lastDepth = distance
+		return nil
+	})
+	sort.Slice(leaves, func(i, j int) bool { return leaves[i].c.weight < leaves[j].c.weight })
+
+	target := int(d.LowWater * float64(d.Budget))
+	if target >= d.Budget {
+		target = d.Budget - 1
+	}
+	removed := 0
+	for _, l := range leaves {
+		if d.size <= target || l.c.weight >= below {
+			break
+		}
+		l.parent.weight += l.c.weight
+		d.root.Remove(l.ipnet)
+		d.size--
+		removed++
+	}
+
+	if removed == 0 {
+		d.floor = ^uint64(0)
+		if len(leaves) > 0 {
+			d.floor = leaves[0].c.weight
+		}
+		return false
+	}
+	return true
+}
+
+//Report returns the hierarchical heavy hitters in traversal order: every prefix whose weight,
+//not counting descendant heavy hitters, is at least phi of the total
+func (d *Detector) Report(phi float64) []HeavyHitter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	//Each element is recorded with the index of its parent, which traversal order puts before it
+	type entry struct {
+		HeavyHitter
+		parent int
+		heavy  bool
+	}
+	var entries []entry
+	var ancestors []int
+	d.root.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+		w := value.(*counter).weight
+		parent := -1
+		if distance > 0 {
+			parent = ancestors[distance-1]
+		}
+		ancestors = append(ancestors[:distance], len(entries))
+		entries = append(entries, entry{HeavyHitter{ipnet, w, w}, parent, false})
+		return nil
+	})
+
+	//Children come after their parent, so going backwards every element has all of its
+	//children's weight by the time it is reached. Heavy hitters keep their weight to themselves
+	threshold := phi * float64(d.total)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := &entries[i]
+		e.heavy = float64(e.Weight) >= threshold && e.Weight > 0
+		if e.parent < 0 {
+			continue
+		}
+		p := &entries[e.parent]
+		p.Total += e.Total
+		if !e.heavy {
+			p.Weight += e.Weight
+		}
+	}
+
+	var hitters []HeavyHitter
+	for _, e := range entries {
+		if e.heavy {
+			hitters = append(hitters, e.HeavyHitter)
+		}
+	}
+	return hitters
+}
@@ -0,0 +1,92 @@
+package heavyhitter_test
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+
+	"iptree"
+	"iptree/heavyhitter"
+)
+
+func TestDetector(t *testing.T) {
+	d := heavyhitter.New(net.IPv4len, 64)
+	r := rand.New(rand.NewSource(1))
+
+	//40% from one host, 30% spread over 10.2.0.0/16, 30% from anywhere
+	attacker := net.IP{203, 0, 113, 7}
+	for i := 0; i < 100000; i++ {
+		var ip net.IP
+		switch n := r.Intn(10); {
+		case n < 4:
+			ip = attacker
+		case n < 7:
+			ip = net.IP{10, 2, byte(r.Intn(256)), byte(r.Intn(256))}
+		default:
+			ip = net.IP{byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))}
+		}
+		if err := d.Ingest(ip, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d.Total() != 1000000 {
+		t.Error(d.Total())
+	}
+	if d.Count() > 64 {
+		t.Errorf("Over budget: %v", d.Count())
+	}
+
+	got := map[string]heavyhitter.HeavyHitter{}
+	for _, h := range d.Report(0.2) {
+		got[h.Prefix.String()] = h
+	}
+	if len(got) != 3 {
+		t.Error(got)
+	}
+	if h, ok := got["203.0.113.7/32"]; !ok || h.Weight < 380000 || h.Weight > 420000 {
+		t.Errorf("attacker: %+v", h)
+	}
+	if h, ok := got["10.2.0.0/16"]; !ok || h.Weight < 250000 || h.Weight > 310000 {
+		t.Errorf("spread: %+v", h)
+	}
+	if h, ok := got["0.0.0.0/0"]; !ok || h.Total != 1000000 {
+		t.Errorf("root: %+v", h)
+	}
+
+	//Wrong IP length (expect error)
+	if err := d.Ingest(net.ParseIP("2001:db8::1"), 1); err != iptree.ErrWrongIPLength {
+		t.Error(err)
+	}
+}
+
+func TestDetectorLowWater(t *testing.T) {
+	d := heavyhitter.New(net.IPv4len, 8)
+	d.Step = 8
+	d.Expand = 0
+	d.LowWater = 0.5
+
+	//Every address expands the root, until the tree holds 8 elements
+	for i := 1; i <= 7; i++ {
+		if err := d.Ingest(net.IP{byte(i), 0, 0, 1}, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.Count() != 8 {
+		t.Errorf("count: %v", d.Count())
+	}
+
+	//The next expansion collapses the tree to 4 elements in one go, then adds one
+	if err := d.Ingest(net.IP{8, 0, 0, 1}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if d.Count() != 5 {
+		t.Errorf("count: %v", d.Count())
+	}
+	if d.Total() != 8 {
+		t.Error(d.Total())
+	}
+	if h := d.Report(0); len(h) == 0 || h[0].Total != 8 {
+		t.Errorf("report: %+v", h)
+	}
+}
@@ -0,0 +1,185 @@
+//Package httpmw provides net/http middleware that looks up the client address of each
+//request in iptree Roots, then allows, denies or annotates the request based on the
+//value of the best matching prefix.
+package httpmw
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"iptree"
+)
+
+//Action is what the middleware does with a request
+type Action int
+
+const (
+	//Annotate passes the request on, with its Match in the request context
+	Annotate Action = iota
+	//Allow is the same as Annotate, but marks the request as explicitly allowed
+	Allow
+	//Deny answers the request with DenyHandler and does not pass it on
+	Deny
+)
+
+func (a Action) String() string {
+	switch a {
+	case Annotate:
+		return "annotate"
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	}
+	return "unknown"
+}
+
+//ErrNoClientIP is returned when the client address of a request can't be parsed
+var ErrNoClientIP = errors.New("Could not determine client IP")
+
+//Match is the result of looking up a request, stored in its context
+type Match struct {
+	ClientIP net.IP
+	//Prefix and Value are the best matching element, or zero if nothing matched
+	Prefix net.IPNet
+	Value  interface{}
+	Found  bool
+	Action Action
+}
+
+//Middleware looks up clients in Trees and applies an Action.
+//The zero value annotates every request, using RemoteAddr as the client address.
+type Middleware struct {
+	//Trees to look clients up in. The first tree with the client's IP length is used,
+	//so an IPv4 and an IPv6 tree may be given together.
+	Trees []iptree.Root
+
+	//Action maps a matched value to an Action. If nil, DefaultAction is used
+	Action func(value interface{}) Action
+
+	//NoMatch is the Action for clients not found in any tree
+	NoMatch Action
+
+	//ClientIP resolves the client address of a request. If nil, RemoteAddr is used.
+	//Use ProxyResolver.ClientIP to trust headers set by proxies.
+	//Requests whose client can't be resolved are denied.
+	ClientIP func(r *http.Request) (net.IP, error)
+
+	//DenyHandler answers denied requests. If nil, a plain 403 Forbidden is sent
+	DenyHandler http.Handler
+}
+
+type contextKey struct{}
+
+//FromContext returns the Match stored by Middleware, if any
+func FromContext(ctx context.Context) (Match, bool) {
+	m, ok := ctx.Value(contextKey{}).(Match)
+	return m, ok
+}
+
+//DefaultAction uses a value that is an Action as is, maps a bool to Allow or Deny,
+//and annotates anything else
+func DefaultAction(value interface{}) Action {
+	switch v := value.(type) {
+	case Action:
+		return v
+	case bool:
+		if v {
+			return Allow
+		}
+		return Deny
+	}
+	return Annotate
+}
+
+//RemoteAddr returns the IP of r.RemoteAddr, which may or may not include a port
+func RemoteAddr(r *http.Request) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, ErrNoClientIP
+	}
+	return ip, nil
+}
+
+//Lookup finds the best match for ip in Trees and decides the Action
+func (m *Middleware) Lookup(ip net.IP) (Match, error) {
+	match := Match{ClientIP: ip, Action: m.NoMatch}
+	prefix, value, err := findIn(m.Trees, ip)
+	if err == iptree.ErrNotFound {
+		return match, nil
+	} else if err != nil {
+		return match, err
+	}
+
+	match.Prefix, match.Value, match.Found = prefix, value, true
+	if m.Action != nil {
+		match.Action = m.Action(value)
+	} else {
+		match.Action = DefaultAction(value)
+	}
+	return match, nil
+}
+
+//Handler wraps next, denying requests or passing them on with their Match in the context
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := m.ClientIP
+		if clientIP == nil {
+			clientIP = RemoteAddr
+		}
+		ip, err := clientIP(r)
+		if err != nil {
+			m.deny(w, r)
+			return
+		}
+		match, err := m.Lookup(ip)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), contextKey{}, match))
+		if match.Action == Deny {
+			m.deny(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *Middleware) deny(w http.ResponseWriter, r *http.Request) {
+	if m.DenyHandler != nil {
+		m.DenyHandler.ServeHTTP(w, r)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+//findIn does a supernet find for ip in the first of trees with its IP length.
+//Returns ErrNotFound if there is no such tree
+func findIn(trees []iptree.Root, ip net.IP) (net.IPNet, interface{}, error) {
+	for _, tree := range trees {
+		if host := hostNet(ip, tree.GetIPLength()); host != nil {
+			return iptree.FindMatch(tree, *host, true)
+		}
+	}
+	return net.IPNet{}, nil, iptree.ErrNotFound
+}
+
+//hostNet returns ip as a single host IPNet, or nil if it is not of length iplen.
+//IPv4 addresses are always of length 4, even if they were parsed as IPv4-mapped IPv6.
+func hostNet(ip net.IP, iplen int) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if len(ip) != iplen {
+		return nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(iplen*8, iplen*8)}
+}
@@ -0,0 +1,94 @@
+package httpmw_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"iptree"
+	"iptree/httpmw"
+)
+
+func mustInsert(t *testing.T, tree iptree.Root, cidr string, value interface{}) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Insert(*ipnet, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	v4 := iptree.NewDefaultRoot(net.IPv4len, false)
+	mustInsert(t, v4, "10.0.0.0/8", true)
+	mustInsert(t, v4, "10.66.0.0/16", false)
+	mustInsert(t, v4, "192.168.0.0/16", "office")
+	v6 := iptree.NewDefaultRoot(net.IPv6len, httpmw.Annotate)
+	mustInsert(t, v6, "2001:db8::/32", httpmw.Allow)
+
+	var got httpmw.Match
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = httpmw.FromContext(r.Context())
+	})
+	m := &httpmw.Middleware{Trees: []iptree.Root{v6, v4}}
+	h := m.Handler(next)
+
+	for _, c := range []struct {
+		remote string
+		code   int
+		prefix string
+		action httpmw.Action
+	}{
+		{"10.1.2.3:1234", http.StatusOK, "10.0.0.0/8", httpmw.Allow},
+		{"10.66.1.1:1234", http.StatusForbidden, "", 0},
+		{"192.168.7.7:80", http.StatusOK, "192.168.0.0/16", httpmw.Annotate},
+		{"8.8.8.8:53", http.StatusForbidden, "", 0},
+		{"[2001:db8::1]:443", http.StatusOK, "2001:db8::/32", httpmw.Allow},
+		{"[2001:4860::1]:443", http.StatusOK, "::/0", httpmw.Annotate},
+		{"[::ffff:10.1.2.3]:80", http.StatusOK, "10.0.0.0/8", httpmw.Allow},
+		{"not an address", http.StatusForbidden, "", 0},
+	} {
+		got = httpmw.Match{}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("%v: code %v", c.remote, rec.Code)
+		}
+		if c.code == http.StatusOK && (got.Prefix.String() != c.prefix || got.Action != c.action || !got.Found) {
+			t.Errorf("%v: %+v", c.remote, got)
+		}
+	}
+
+	//Custom actions and deny handler, nothing matches in an IPv4 only tree
+	m = &httpmw.Middleware{
+		Trees:   []iptree.Root{v4},
+		NoMatch: httpmw.Deny,
+		Action: func(value interface{}) httpmw.Action {
+			if value == "office" {
+				return httpmw.Allow
+			}
+			return httpmw.Deny
+		},
+		DenyHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}),
+	}
+	h = m.Handler(next)
+	for remote, code := range map[string]int{
+		"192.168.1.1:80":    http.StatusOK,
+		"10.1.2.3:80":       http.StatusTeapot,
+		"[2001:db8::1]:443": http.StatusTeapot,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("%v: code %v", remote, rec.Code)
+		}
+	}
+}
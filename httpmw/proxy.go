@@ -0,0 +1,219 @@
+package httpmw
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"iptree"
+)
+
+//Header names understood by ProxyResolver
+const (
+	HeaderForwarded     = "Forwarded"
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderXRealIP       = "X-Real-IP"
+)
+
+//ErrInvalidHop is returned when a trusted proxy reports a hop that is not an IP address,
+//such as "unknown" or an obfuscated identifier
+var ErrInvalidHop = errors.New("Invalid address in proxy header")
+
+//Hop is a trusted proxy a request passed through, with the prefix that trusted it
+type Hop struct {
+	IP     net.IP
+	Prefix net.IPNet
+	Value  interface{}
+}
+
+//Resolution is the result of ProxyResolver.Resolve
+type Resolution struct {
+	//Client is the first untrusted address, or the furthest address if all are trusted
+	Client net.IP
+	//Proxies are the trusted hops, nearest (RemoteAddr) first
+	Proxies []Hop
+	//Header the client was read from, or empty if it is RemoteAddr
+	Header string
+}
+
+//ProxyResolver finds the client address of requests that went through trusted proxies.
+//Addresses are trusted if their best match in Trusted has a value other than nil or false.
+type ProxyResolver struct {
+	//Trusted proxy networks. As with Middleware.Trees, IPv4 and IPv6 trees may be given together
+	Trusted []iptree.Root
+
+	//Header to read hops from, which must be the one the nearest trusted proxy sets.
+	//Only one is read, as a client can send any header its proxies do not overwrite.
+	//If empty, X-Forwarded-For is used
+	Header string
+}
+
+//ClientIP returns the client address found by Resolve, for use as Middleware.ClientIP
+func (p *ProxyResolver) ClientIP(r *http.Request) (net.IP, error) {
+	res, err := p.Resolve(r)
+	return res.Client, err
+}
+
+//Resolve walks the hops of r from RemoteAddr outwards (right to left in the headers),
+//stopping at the first one not in a trusted network
+func (p *ProxyResolver) Resolve(r *http.Request) (Resolution, error) {
+	remote, err := RemoteAddr(r)
+	if err != nil {
+		return Resolution{}, err
+	}
+	res := Resolution{Client: remote}
+	hop, trusted, err := p.trust(remote)
+	if err != nil || !trusted {
+		return res, err
+	}
+	res.Proxies = append(res.Proxies, hop)
+
+	name := p.Header
+	if name == "" {
+		name = HeaderXForwardedFor
+	}
+	values := r.Header.Values(name)
+	if len(values) == 0 {
+		return res, nil
+	}
+	res.Header = name
+
+	//Compare canonical forms, as X-Real-IP is X-Real-Ip once canonical
+	var hops []string
+	switch http.CanonicalHeaderKey(name) {
+	case http.CanonicalHeaderKey(HeaderForwarded):
+		hops, err = parseForwarded(values)
+		if err != nil {
+			return res, err
+		}
+	case http.CanonicalHeaderKey(HeaderXRealIP):
+		hops = values[len(values)-1:]
+	default:
+		hops = splitList(values)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == nil {
+			return res, ErrInvalidHop
+		}
+		res.Client = ip
+		if hop, trusted, err = p.trust(ip); err != nil || !trusted {
+			return res, err
+		}
+		res.Proxies = append(res.Proxies, hop)
+	}
+	return res, nil
+}
+
+//trust looks ip up in Trusted
+func (p *ProxyResolver) trust(ip net.IP) (Hop, bool, error) {
+	prefix, value, err := findIn(p.Trusted, ip)
+	if err == iptree.ErrNotFound {
+		return Hop{}, false, nil
+	} else if err != nil {
+		return Hop{}, false, err
+	}
+	if value == nil || value == false {
+		return Hop{}, false, nil
+	}
+	return Hop{IP: ip, Prefix: prefix, Value: value}, true, nil
+}
+
+//splitList splits comma separated header values into trimmed, non-empty items
+func splitList(values []string) []string {
+	var items []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+//parseForwarded returns the "for" parameter of every element of RFC 7239 Forwarded headers.
+//Elements without a "for" parameter are returned as empty strings.
+func parseForwarded(values []string) ([]string, error) {
+	var hops []string
+	for _, v := range values {
+		elems, err := splitQuoted(v, ',')
+		if err != nil {
+			return nil, err
+		}
+		for _, elem := range elems {
+			if strings.TrimSpace(elem) == "" {
+				continue
+			}
+			pairs, err := splitQuoted(elem, ';')
+			if err != nil {
+				return nil, err
+			}
+			hop := ""
+			for _, pair := range pairs {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					return nil, ErrInvalidHop
+				}
+				if strings.EqualFold(key, "for") {
+					hop = unquote(value)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops, nil
+}
+
+//splitQuoted splits s at sep, except inside quoted strings
+func splitQuoted(s string, sep byte) ([]string, error) {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, ErrInvalidHop
+	}
+	return append(parts, s[start:]), nil
+}
+
+//unquote removes the quotes and escapes of a quoted string, if s is one
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+//parseHop parses an address as found in proxy headers: an IP with an optional port,
+//with IPv6 addresses optionally in brackets. Returns nil if it isn't an IP address
+func parseHop(s string) net.IP {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		return net.ParseIP(s[1 : len(s)-1])
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package httpmw_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"iptree"
+	"iptree/httpmw"
+)
+
+func TestProxyResolver(t *testing.T) {
+	v4 := iptree.NewDefaultRoot(net.IPv4len, nil)
+	mustInsert(t, v4, "10.0.0.0/8", "internal")
+	mustInsert(t, v4, "10.99.0.0/16", false)
+	mustInsert(t, v4, "203.0.113.0/24", "cdn")
+	v6 := iptree.NewDefaultRoot(net.IPv6len, nil)
+	mustInsert(t, v6, "2001:db8::/32", true)
+
+	for _, c := range []struct {
+		header  string //ProxyResolver.Header
+		remote  string
+		headers map[string][]string
+		client  string
+		proxies string
+		err     error
+	}{
+		//Untrusted remote, headers are ignored
+		{"", "198.51.100.1:1", map[string][]string{"X-Forwarded-For": {"1.1.1.1"}}, "198.51.100.1", "", nil},
+		//Trusted remote without headers
+		{"", "10.0.0.1:1", nil, "10.0.0.1", "10.0.0.1@10.0.0.0/8", nil},
+		//Walk right to left, stop at the first untrusted hop
+		{"", "10.0.0.1:1", map[string][]string{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4", "203.0.113.9"}}, "1.2.3.4",
+			"10.0.0.1@10.0.0.0/8 203.0.113.9@203.0.113.0/24", nil},
+		//false is not trusted
+		{"", "10.0.0.1:1", map[string][]string{"X-Forwarded-For": {"1.2.3.4, 10.99.0.1"}}, "10.99.0.1", "10.0.0.1@10.0.0.0/8", nil},
+		//All trusted, the furthest hop is the client
+		{"", "10.0.0.1:1", map[string][]string{"X-Forwarded-For": {"10.1.1.1"}}, "10.1.1.1",
+			"10.0.0.1@10.0.0.0/8 10.1.1.1@10.0.0.0/8", nil},
+		//Only the configured header is read, so a client cannot pick one its proxy does not set
+		{"", "10.0.0.1:1", map[string][]string{"X-Real-IP": {"10.1.1.1"}, "Forwarded": {"for=10.1.1.1"}}, "10.0.0.1",
+			"10.0.0.1@10.0.0.0/8", nil},
+		//X-Real-IP is a single address, so only the last one is used, in any case
+		{"X-Real-IP", "10.0.0.1:1", map[string][]string{"X-Real-IP": {"1.2.3.4", "10.1.1.1"}}, "10.1.1.1",
+			"10.0.0.1@10.0.0.0/8 10.1.1.1@10.0.0.0/8", nil},
+		{"x-real-ip", "10.0.0.1:1", map[string][]string{"X-Real-IP": {"1.2.3.4", "10.1.1.1"}}, "10.1.1.1",
+			"10.0.0.1@10.0.0.0/8 10.1.1.1@10.0.0.0/8", nil},
+		//Forwarded, with quoting, IPv6 and ports
+		{"Forwarded", "[2001:db8::1]:443", map[string][]string{
+			"Forwarded":       {`for=192.0.2.60;proto=http;by=203.0.113.43, For="[2001:db8:cafe::17]:4711";host="a,b"`},
+			"X-Forwarded-For": {"1.1.1.1"},
+		}, "192.0.2.60", "2001:db8::1@2001:db8::/32 2001:db8:cafe::17@2001:db8::/32", nil},
+		//Unknown hop reported by a trusted proxy (expect error)
+		{"Forwarded", "10.0.0.1:1", map[string][]string{"Forwarded": {"for=unknown"}}, "", "", httpmw.ErrInvalidHop},
+		{"Forwarded", "10.0.0.1:1", map[string][]string{"Forwarded": {`for="1.2.3.4`}}, "", "", httpmw.ErrInvalidHop},
+	} {
+		p := &httpmw.ProxyResolver{Trusted: []iptree.Root{v4, v6}, Header: c.header}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+		for k, values := range c.headers {
+			for _, v := range values {
+				req.Header.Add(k, v)
+			}
+		}
+		res, err := p.Resolve(req)
+		if err != c.err {
+			t.Errorf("%v %v: %v", c.remote, c.headers, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var proxies []string
+		for _, hop := range res.Proxies {
+			proxies = append(proxies, hop.IP.String()+"@"+hop.Prefix.String())
+		}
+		if res.Client.String() != c.client || strings.Join(proxies, " ") != c.proxies {
+			t.Errorf("%v %v: %v %v", c.remote, c.headers, res.Client, proxies)
+		}
+	}
+
+	//Plug into Middleware, deny requests that claim to come from an internal address
+	p := &httpmw.ProxyResolver{Trusted: []iptree.Root{v4, v6}}
+	policy := iptree.NewDefaultRoot(net.IPv4len, true)
+	mustInsert(t, policy, "10.0.0.0/8", false)
+	h := (&httpmw.Middleware{Trees: []iptree.Root{policy}, ClientIP: p.ClientIP}).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for xff, code := range map[string]int{
+		"1.2.3.4":         http.StatusOK,
+		"10.5.5.5":        http.StatusForbidden,
+		"10.5.5.5, bogus": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "203.0.113.1:1"
+		req.Header.Set("X-Forwarded-For", xff)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("%v: code %v", xff, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package iptree
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+//KeyFunc returns the key a value is indexed under, which must be usable as a map key.
+//Values with a nil key are not indexed.
+type KeyFunc func(value interface{}) interface{}
+
+//IndexedRoot is a Root that keeps an index from value keys to prefixes, updated by every operation.
+//New roots returned in ErrNewRoot and ErrRemovedRoot are IndexedRoots sharing the same index.
+//
+//An IndexedRoot is safe for concurrent use. The functions passed to Traverse, Update and
+//RemoveIf are called with it locked, so they must not use it.
+//
+//A TTLRoot removes expired elements without telling the Roots it wraps, so it cannot be
+//indexed. Wrap the IndexedRoot with WithTTL instead, which removes them through it.
+type IndexedRoot struct {
+	Root
+	idx *valueIndex
+}
+
+//valueIndex maps keys to the prefixes holding them
+type valueIndex struct {
+	//mu guards the index and every Root sharing it
+	mu    sync.RWMutex
+	key   KeyFunc
+	byKey map[interface{}]map[string]net.IPNet
+}
+
+//NewIndexedRoot returns an IndexedRoot that applies every operation to root,
+//indexing every existing element with key.
+//If root is, or wraps, a TTLRoot, returns ErrExpiringRoot.
+func NewIndexedRoot(root Root, key KeyFunc) (*IndexedRoot, error) {
+	for r := root; r != nil; {
+		if _, ok := r.(*TTLRoot); ok {
+			return nil, ErrExpiringRoot
+		}
+		w, ok := r.(wrapper)
+		if !ok {
+			break
+		}
+		r = w.unwrap()
+	}
+
+	idx := &valueIndex{key: key, byKey: make(map[interface{}]map[string]net.IPNet)}
+	if err := root.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+		idx.add(ipnet, value)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &IndexedRoot{root, idx}, nil
+}
+
+//PrefixesFor returns every prefix whose value has key, in address order
+func (r *IndexedRoot) PrefixesFor(key interface{}) []net.IPNet {
+	r.idx.mu.RLock()
+	set := r.idx.byKey[key]
+	prefixes := make([]net.IPNet, 0, len(set))
+	for _, ipnet := range set {
+		prefixes = append(prefixes, ipnet)
+	}
+	r.idx.mu.RUnlock()
+
+	sort.Slice(prefixes, func(i, j int) bool {
+		if ipdiff := compareIP(prefixes[i].IP, prefixes[j].IP); ipdiff != 0 {
+			return ipdiff < 0
+		}
+		return compareMask(prefixes[i].Mask, prefixes[j].Mask) < 0
+	})
+	return prefixes
+}
+
+func (idx *valueIndex) add(ipnet net.IPNet, value interface{}) {
+	k := idx.key(value)
+	if k == nil {
+		return
+	}
+	set, ok := idx.byKey[k]
+	if !ok {
+		set = make(map[string]net.IPNet)
+		idx.byKey[k] = set
+	}
+	set[netKey(ipnet)] = ipnet
+}
+
+func (idx *valueIndex) remove(ipnet net.IPNet, value interface{}) {
+	k := idx.key(value)
+	if k == nil {
+		return
+	}
+	set := idx.byKey[k]
+	delete(set, netKey(ipnet))
+	if len(set) == 0 {
+		delete(idx.byKey, k)
+	}
+}
+
+//apply updates the index with the Events of a change
+func (idx *valueIndex) apply(events []Event) {
+	for _, e := range events {
+		switch e.Type {
+		case EventInserted:
+			idx.add(e.IPNet, e.Value)
+		case EventRemoved:
+			idx.remove(e.IPNet, e.Value)
+		case EventValueChanged:
+			idx.remove(e.IPNet, e.OldValue)
+			idx.add(e.IPNet, e.Value)
+		}
+	}
+}
+
+func (r *IndexedRoot) Find(ipnet net.IPNet, allowSupernet bool) (interface{}, error) {
+	r.idx.mu.RLock()
+	defer r.idx.mu.RUnlock()
+	return r.Root.Find(ipnet, allowSupernet)
+}
+
+func (r *IndexedRoot) FindMatch(ipnet net.IPNet, allowSupernet bool) (net.IPNet, interface{}, error) {
+	r.idx.mu.RLock()
+	defer r.idx.mu.RUnlock()
+	return FindMatch(r.Root, ipnet, allowSupernet)
+}
+
+func (r *IndexedRoot) Insert(ipnet net.IPNet, value interface{}) error {
+	return r.mutate(insertion(ipnet, value), nil)
+}
+
+func (r *IndexedRoot) Update(ipnet net.IPNet, f Updater) error {
+	return r.mutate(mutation{op: mopUpdate, ipnet: ipnet, updater: f}, nil)
+}
+
+func (r *IndexedRoot) Remove(ipnet net.IPNet) error {
+	return r.mutate(mutation{op: mopRemove, ipnet: ipnet}, nil)
+}
+
+func (r *IndexedRoot) RemoveSubtree(ipnet net.IPNet) error {
+	return r.mutate(mutation{op: mopRemoveSubtree, ipnet: ipnet}, nil)
+}
+
+func (r *IndexedRoot) RemoveIf(pred Predicate) error {
+	return r.mutate(mutation{op: mopRemoveIf, pred: pred}, nil)
+}
+
+func (r *IndexedRoot) Prune(maxDepth int) error {
+	return r.mutate(mutation{op: mopPrune, maxDepth: maxDepth}, nil)
+}
+
+//mutate applies m with the index locked, and updates the index with the Events it causes
+func (r *IndexedRoot) mutate(m mutation, c *changeLog) error {
+	r.idx.mu.Lock()
+	defer r.idx.mu.Unlock()
+
+	var changes changeLog
+	err := mutate(r.Root, m, &changes)
+	if !succeeded(err) {
+		return err
+	}
+	r.idx.apply(changes.events)
+	if c != nil {
+		c.events = append(c.events, changes.events...)
+	}
+	return r.wrapRoots(err)
+}
+
+func (r *IndexedRoot) Traverse(f Traverser) error {
+	r.idx.mu.RLock()
+	defer r.idx.mu.RUnlock()
+	return r.Root.Traverse(f)
+}
+
+func (r *IndexedRoot) GetIPLength() int {
+	r.idx.mu.RLock()
+	defer r.idx.mu.RUnlock()
+	return r.Root.GetIPLength()
+}
+
+func (r *IndexedRoot) Count() int {
+	r.idx.mu.RLock()
+	defer r.idx.mu.RUnlock()
+	return r.Root.Count()
+}
+
+//wrapRoots makes any new roots in err share the same index
+func (r *IndexedRoot) wrapRoots(err error) error {
+	switch e := err.(type) {
+	case ErrNewRoot:
+		return ErrNewRoot{&IndexedRoot{e.NewRoot, r.idx}}
+	case ErrRemovedRoot:
+		for i, nr := range e.NewRoots {
+			e.NewRoots[i] = &IndexedRoot{nr, r.idx}
+		}
+		return e
+	}
+	return err
+}
+
+func (r *IndexedRoot) unwrap() Root {
+	return r.Root
+}
+
+//rewrap builds a new index for a committed transaction, leaving the original untouched
+func (r *IndexedRoot) rewrap(root Root, ops []txOp, events []Event) (Root, error) {
+	return NewIndexedRoot(root, r.idx.key)
+}
@@ -0,0 +1,158 @@
+package iptree_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"iptree"
+)
+
+func buildOwnerTree(t *testing.T) iptree.Root {
+	tree := iptree.NewDefaultRoot(net.IPv4len, "ops")
+	for _, e := range [][2]string{
+		{"10.0.0.0/8", "alice"},
+		{"10.1.0.0/16", "bob"},
+		{"10.1.1.0/24", "alice"},
+		{"192.168.0.0/16", "bob"},
+	} {
+		_, ipnet, err := net.ParseCIDR(e[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Insert(*ipnet, e[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tree
+}
+
+func ownerKey(value interface{}) interface{} {
+	return value
+}
+
+func prefixesString(prefixes []net.IPNet) string {
+	s := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		s[i] = p.String()
+	}
+	return strings.Join(s, " ")
+}
+
+func TestIndexedRoot(t *testing.T) {
+	for _, foreign := range []bool{false, true} {
+		root := buildOwnerTree(t)
+		if foreign {
+			//A Root from outside this package is indexed by comparing the tree
+			root = plainRoot{root}
+		}
+		tree, err := iptree.NewIndexedRoot(root, ownerKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check := func(step, key, want string) {
+			if got := prefixesString(tree.PrefixesFor(key)); got != want {
+				t.Errorf("Error: %v (foreign %v), %v: %v", step, foreign, key, got)
+			}
+		}
+		check("new", "alice", "10.0.0.0/8 10.1.1.0/24")
+		check("new", "bob", "10.1.0.0/16 192.168.0.0/16")
+
+		//Changing a value moves it to the new key
+		_, ten1, _ := net.ParseCIDR("10.1.0.0/16")
+		if err := iptree.Update(tree, *ten1, func(interface{}, bool) (interface{}, bool) {
+			return "alice", true
+		}); err != nil {
+			t.Error(err)
+		}
+		check("update", "alice", "10.0.0.0/8 10.1.0.0/16 10.1.1.0/24")
+		check("update", "bob", "192.168.0.0/16")
+
+		//Removing with Update keeps the children
+		_, ten, _ := net.ParseCIDR("10.0.0.0/8")
+		if err := iptree.Update(tree, *ten, func(interface{}, bool) (interface{}, bool) {
+			return nil, false
+		}); err != nil {
+			t.Error(err)
+		}
+		check("update delete", "alice", "10.1.0.0/16 10.1.1.0/24")
+
+		//Remove drops the subtree
+		if err := tree.Remove(*ten1); err != nil {
+			t.Error(err)
+		}
+		check("remove", "alice", "")
+
+		//RemoveIf
+		if err := iptree.RemoveIf(tree, func(ipnet net.IPNet, value interface{}) bool {
+			return value == "bob"
+		}); err != nil {
+			t.Error(err)
+		}
+		check("remove if", "bob", "")
+
+		//Prune, then RemoveSubtree
+		for _, s := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24"} {
+			_, ipnet, _ := net.ParseCIDR(s)
+			if err := tree.Insert(*ipnet, "carol"); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := iptree.Prune(tree, 2); err != nil {
+			t.Error(err)
+		}
+		check("prune", "carol", "10.0.0.0/8 10.1.0.0/16")
+		if err := iptree.RemoveSubtree(tree, *ten1); err != nil {
+			t.Error(err)
+		}
+		check("remove subtree", "carol", "10.0.0.0/8")
+
+		//Removing the root keeps its children indexed, in new IndexedRoots
+		_, root0, _ := net.ParseCIDR("0.0.0.0/0")
+		err = tree.Remove(*root0)
+		rr, ok := err.(iptree.ErrRemovedRoot)
+		if !ok || len(rr.NewRoots) != 1 {
+			t.Fatal(err)
+		}
+		newTree, ok := rr.NewRoots[0].(*iptree.IndexedRoot)
+		if !ok {
+			t.Fatalf("%T", rr.NewRoots[0])
+		}
+		check("remove root", "ops", "")
+		check("remove root", "carol", "10.0.0.0/8")
+		if err := newTree.Insert(*ten1, "carol"); err != nil {
+			t.Error(err)
+		}
+		check("new root", "carol", "10.0.0.0/8 10.1.0.0/16")
+	}
+}
+
+func TestIndexedRootTTL(t *testing.T) {
+	//A TTLRoot cannot be indexed (expect error)
+	if _, err := iptree.NewIndexedRoot(iptree.WithTTL(buildOwnerTree(t), nil, nil), ownerKey); err != iptree.ErrExpiringRoot {
+		t.Error(err)
+	}
+
+	//Wrapped the other way round, expiries go through the index
+	clock := newFakeClock()
+	tree, err := iptree.NewIndexedRoot(buildOwnerTree(t), ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl := iptree.WithTTL(tree, clock, nil)
+	_, ipnet, _ := net.ParseCIDR("203.0.113.0/24")
+	if err := ttl.InsertWithTTL(*ipnet, "bob", time.Minute); err != nil {
+		t.Error(err)
+	}
+	if p := prefixesString(tree.PrefixesFor("bob")); p != "10.1.0.0/16 192.168.0.0/16 203.0.113.0/24" {
+		t.Error(p)
+	}
+	clock.Advance(time.Minute)
+	if n := ttl.Expire(); n != 1 {
+		t.Errorf("Expired %v", n)
+	}
+	if p := prefixesString(tree.PrefixesFor("bob")); p != "10.1.0.0/16 192.168.0.0/16" {
+		t.Error(p)
+	}
+}
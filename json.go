@@ -0,0 +1,154 @@
+package iptree
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+)
+
+//JSONTree wraps a Root so it can be encoded and decoded with encoding/json.
+//
+//The nested form mirrors the tree's hierarchy:
+// {"prefix": "0.0.0.0/0", "value": ..., "children": [{"prefix": ..., "value": ...}]}
+//The flat form lists every element in traversal order, root first:
+// [{"prefix": "0.0.0.0/0", "value": ...}, {"prefix": ..., "value": ...}]
+type JSONTree struct {
+	Root Root
+
+	//Flat selects the flat form when encoding. When decoding, either form is
+	//accepted and Flat is set to match the input.
+	Flat bool
+
+	//ValueSerializer is used to encode values if set, otherwise json.Marshal is used.
+	//It must return valid JSON.
+	ValueSerializer ValueSerializer
+
+	//ValueDeserializer is used to decode values if set, and is passed the raw JSON of the value.
+	//Otherwise json.Unmarshal into an interface{} is used.
+	ValueDeserializer ValueDeserializer
+}
+
+//jsonNode is the encoded form of a single element
+type jsonNode struct {
+	Prefix   string          `json:"prefix"`
+	Value    json.RawMessage `json:"value"`
+	Children []*jsonNode     `json:"children,omitempty"`
+}
+
+//MarshalJSON implements json.Marshaler
+func (t JSONTree) MarshalJSON() ([]byte, error) {
+	if t.Root == nil {
+		return []byte("null"), nil
+	}
+
+	serializer := t.ValueSerializer
+	if serializer == nil {
+		serializer = func(value interface{}) ([]byte, error) {
+			return json.Marshal(value)
+		}
+	}
+
+	var flat []*jsonNode
+	//parents[d] is the most recent element seen at distance d
+	parents := make([]*jsonNode, 0, 10)
+
+	if err := t.Root.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+		vbuf, err := serializer(value)
+		if err != nil {
+			return err
+		}
+		jn := &jsonNode{
+			Prefix: ipnet.String(),
+			Value:  json.RawMessage(vbuf),
+		}
+		if t.Flat {
+			flat = append(flat, jn)
+			return nil
+		}
+		parents = append(parents[:distance], jn)
+		if distance > 0 {
+			p := parents[distance-1]
+			p.Children = append(p.Children, jn)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if t.Flat {
+		return json.Marshal(flat)
+	}
+	return json.Marshal(parents[0])
+}
+
+//UnmarshalJSON implements json.Unmarshaler, replacing t.Root with the decoded tree
+//Prefixes with host bits set are read as their network, so 10.1.2.3/8 is 10.0.0.0/8.
+func (t *JSONTree) UnmarshalJSON(data []byte) error {
+	deserializer := t.ValueDeserializer
+	if deserializer == nil {
+		deserializer = func(vbytes []byte) (interface{}, error) {
+			var value interface{}
+			err := json.Unmarshal(vbytes, &value)
+			return value, err
+		}
+	}
+
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		t.Root = nil
+		return nil
+	}
+
+	var flat []*jsonNode
+	t.Flat = bytes.HasPrefix(data, []byte("["))
+	if t.Flat {
+		if err := json.Unmarshal(data, &flat); err != nil {
+			return err
+		}
+	} else {
+		var jn jsonNode
+		if err := json.Unmarshal(data, &jn); err != nil {
+			return err
+		}
+		flat = flattenJSON(&jn, flat)
+	}
+
+	if len(flat) == 0 {
+		return ErrInvalidData
+	}
+
+	var root Root
+	for _, jn := range flat {
+		ipnet, err := parseCIDR(jn.Prefix)
+		if err != nil {
+			return err
+		}
+		value, err := deserializer(jn.Value)
+		if err != nil {
+			return err
+		}
+
+		if root == nil {
+			root = makeNode(ipnet, value, nil)
+			continue
+		}
+		err = root.Insert(ipnet, value)
+		if nr, ok := err.(ErrNewRoot); ok {
+			root = nr.NewRoot
+		} else if err != nil {
+			return err
+		}
+	}
+
+	t.Root = root
+	return nil
+}
+
+//flattenJSON appends jn and all its descendants to flat, in traversal order
+func flattenJSON(jn *jsonNode, flat []*jsonNode) []*jsonNode {
+	flat = append(flat, jn)
+	for _, c := range jn.Children {
+		flat = flattenJSON(c, flat)
+	}
+	return flat
+}
@@ -0,0 +1,98 @@
+package iptree_test
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"iptree"
+)
+
+func TestJSONTree(t *testing.T) {
+	want, _ := traverseString(buildStreamTree(t))
+
+	for _, flat := range []bool{false, true} {
+		//Round trip
+		data, err := json.Marshal(iptree.JSONTree{Root: buildStreamTree(t), Flat: flat})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded iptree.JSONTree
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Flat != flat {
+			t.Errorf("Flat: %v, want %v", decoded.Flat, flat)
+		}
+		if got, err := traverseString(decoded.Root); err != nil || got != want {
+			t.Errorf("Error: %v, flat: %v, got:\n%v", err, flat, got)
+		}
+	}
+
+	//The nested form
+	data, err := json.Marshal(iptree.JSONTree{Root: buildStreamTree(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(data); s != `{"prefix":"0.0.0.0/0","value":"default","children":[`+
+		`{"prefix":"10.0.0.0/8","value":"10.0.0.0/8","children":[`+
+		`{"prefix":"10.1.0.0/16","value":"10.1.0.0/16","children":[`+
+		`{"prefix":"10.1.1.0/24","value":"10.1.1.0/24","children":[`+
+		`{"prefix":"10.1.1.128/25","value":"10.1.1.128/25"}]}]},`+
+		`{"prefix":"10.2.0.0/16","value":"10.2.0.0/16"}]},`+
+		`{"prefix":"192.168.0.0/16","value":"192.168.0.0/16"}]}` {
+		t.Error(s)
+	}
+
+	//Custom value functions
+	data, err = json.Marshal(iptree.JSONTree{Root: buildStreamTree(t), Flat: true, ValueSerializer: func(v interface{}) ([]byte, error) {
+		return json.Marshal(len(v.(string)))
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := iptree.JSONTree{ValueDeserializer: func(vbytes []byte) (interface{}, error) {
+		var n int
+		err := json.Unmarshal(vbytes, &n)
+		return n, err
+	}}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	_, ipnet, _ := net.ParseCIDR("10.1.1.128/25")
+	if v, err := decoded.Root.Find(*ipnet, false); err != nil || v != 13 {
+		t.Errorf("Error: %v, v: %v", err, v)
+	}
+
+	//null is a nil Root
+	decoded = iptree.JSONTree{Root: buildStreamTree(t)}
+	if err := json.Unmarshal([]byte("null"), &decoded); err != nil || decoded.Root != nil {
+		t.Errorf("Error: %v, root: %v", err, decoded.Root)
+	}
+	if data, err := json.Marshal(decoded); err != nil || string(data) != "null" {
+		t.Errorf("Error: %v, data: %s", err, data)
+	}
+
+	//Malformed input (expect error)
+	for _, s := range []string{
+		`{"prefix":`,
+		`[]`,
+		`{"prefix":"10.0.0.0/33","value":1}`,
+		`{"prefix":"not a prefix","value":1}`,
+		`[{"prefix":"0.0.0.0/0","value":1},{"prefix":"::/0","value":2}]`,
+		`{"prefix":"0.0.0.0/0","value":}`,
+	} {
+		var decoded iptree.JSONTree
+		if err := json.Unmarshal([]byte(s), &decoded); err == nil {
+			t.Errorf("No error for %v", s)
+		}
+	}
+
+	//A prefix with host bits set is read as its network
+	if err := json.Unmarshal([]byte(`[{"prefix":"0.0.0.0/0","value":"default"},{"prefix":"10.1.2.3/8","value":"ten"}]`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := traverseString(decoded.Root); err != nil || got != "0.0.0.0/0: default\n 10.0.0.0/8: ten\n" {
+		t.Errorf("Error: %v, got:\n%v", err, got)
+	}
+}
@@ -0,0 +1,176 @@
+package mrt
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+//decoder reads fields from a record. After the first failed read, err is set
+//and every further read returns zero values
+type decoder struct {
+	data []byte
+	err  string
+}
+
+func (d *decoder) bytes(n int, what string) []byte {
+	if d.err != "" {
+		return nil
+	}
+	if n > len(d.data) {
+		d.err = "truncated " + what
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) u8(what string) byte {
+	if b := d.bytes(1, what); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) u16(what string) uint16 {
+	if b := d.bytes(2, what); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) u32(what string) uint32 {
+	if b := d.bytes(4, what); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+//ip copies an address, as the record buffer is reused
+func (d *decoder) ip(n int, what string) net.IP {
+	if b := d.bytes(n, what); b != nil {
+		return append(net.IP(nil), b...)
+	}
+	return nil
+}
+
+//peerIndex decodes a PEER_INDEX_TABLE record
+func (d *decoder) peerIndex() []Peer {
+	d.u32("collector BGP ID")
+	d.bytes(int(d.u16("view name length")), "view name")
+	count := int(d.u16("peer count"))
+
+	peers := make([]Peer, 0, count)
+	for i := 0; i < count && d.err == ""; i++ {
+		typ := d.u8("peer type")
+		var p Peer
+		p.BGPID = d.ip(net.IPv4len, "peer BGP ID")
+		if typ&0x01 != 0 {
+			p.IP = d.ip(net.IPv6len, "peer IP")
+		} else {
+			p.IP = d.ip(net.IPv4len, "peer IP")
+		}
+		if typ&0x02 != 0 {
+			p.AS = d.u32("peer AS")
+		} else {
+			p.AS = uint32(d.u16("peer AS"))
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+//rib decodes a RIB_IPV4_UNICAST or RIB_IPV6_UNICAST record
+func (d *decoder) rib(iplen int, peers []Peer) *RIB {
+	rib := &RIB{Sequence: d.u32("sequence number")}
+	ones := int(d.u8("prefix length"))
+	if ones > iplen*8 {
+		d.err = "prefix length out of range"
+		return nil
+	}
+	ip := make(net.IP, iplen)
+	copy(ip, d.bytes((ones+7)/8, "prefix"))
+	mask := net.CIDRMask(ones, iplen*8)
+	rib.Prefix = net.IPNet{IP: ip.Mask(mask), Mask: mask}
+
+	count := int(d.u16("entry count"))
+	rib.Entries = make([]Entry, 0, count)
+	for i := 0; i < count && d.err == ""; i++ {
+		index := int(d.u16("peer index"))
+		if d.err == "" && index >= len(peers) {
+			d.err = "peer index out of range"
+			return nil
+		}
+		e := Entry{Originated: time.Unix(int64(d.u32("originated time")), 0).UTC()}
+		attrs := decoder{data: d.bytes(int(d.u16("attribute length")), "attributes")}
+		if d.err != "" {
+			return nil
+		}
+		e.Peer = peers[index]
+		attrs.attributes(&e)
+		if attrs.err != "" {
+			d.err = attrs.err
+			return nil
+		}
+		rib.Entries = append(rib.Entries, e)
+	}
+	return rib
+}
+
+//attributes decodes the BGP path attributes used by Entry, skipping the rest
+func (d *decoder) attributes(e *Entry) {
+	for len(d.data) > 0 && d.err == "" {
+		flags := d.u8("attribute flags")
+		typ := d.u8("attribute type")
+		var length int
+		if flags&0x10 != 0 { //Extended length
+			length = int(d.u16("attribute length"))
+		} else {
+			length = int(d.u8("attribute length"))
+		}
+		value := decoder{data: d.bytes(length, "attribute")}
+		if d.err != "" {
+			return
+		}
+
+		switch typ {
+		case attrOrigin:
+			e.Origin = value.u8("origin")
+		case attrASPath:
+			//TABLE_DUMP_V2 always uses 4 byte ASNs
+			for len(value.data) > 0 && value.err == "" {
+				seg := Segment{Type: value.u8("segment type")}
+				n := int(value.u8("segment length"))
+				for j := 0; j < n && value.err == ""; j++ {
+					seg.ASNs = append(seg.ASNs, value.u32("ASN"))
+				}
+				e.ASPath = append(e.ASPath, seg)
+			}
+			e.OriginAS = 0
+			if last := len(e.ASPath) - 1; last >= 0 && e.ASPath[last].Type == ASSequence && len(e.ASPath[last].ASNs) > 0 {
+				e.OriginAS = e.ASPath[last].ASNs[len(e.ASPath[last].ASNs)-1]
+			}
+		case attrNextHop:
+			e.NextHop = value.ip(net.IPv4len, "next hop")
+		case attrCommunities:
+			for len(value.data) > 0 && value.err == "" {
+				e.Communities = append(e.Communities, value.u32("community"))
+			}
+		case attrMPReachNLRI:
+			//Usually only the next hop length and next hop, but some writers include the AFI and SAFI
+			if len(value.data) >= 4 && len(value.data) != int(value.data[0])+1 {
+				value.bytes(3, "AFI and SAFI")
+			}
+			n := int(value.u8("next hop length"))
+			//A second, link local, next hop may follow the first
+			if n == 2*net.IPv6len {
+				n = net.IPv6len
+			}
+			e.NextHop = value.ip(n, "next hop")
+		}
+		if value.err != "" {
+			d.err = value.err
+		}
+	}
+}
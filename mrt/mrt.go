@@ -0,0 +1,197 @@
+//Package mrt reads BGP routing tables from MRT (RFC 6396) TABLE_DUMP_V2 dumps, as published
+//by route collectors, into iptree Roots.
+package mrt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"iptree"
+)
+
+//MRT record types and TABLE_DUMP_V2 subtypes
+const (
+	TypeTableDumpV2 = 13
+
+	SubtypePeerIndexTable = 1
+	SubtypeRIBIPv4Unicast = 2
+	SubtypeRIBIPv6Unicast = 4
+)
+
+//BGP path attribute types read into Entry
+const (
+	attrOrigin      = 1
+	attrASPath      = 2
+	attrNextHop     = 3
+	attrCommunities = 8
+	attrMPReachNLRI = 14
+)
+
+//AS path segment types
+const (
+	ASSet      = 1
+	ASSequence = 2
+)
+
+//Origin attribute values
+const (
+	OriginIGP        = 0
+	OriginEGP        = 1
+	OriginIncomplete = 2
+)
+
+//maxRecordLength bounds the buffer allocated for one record
+const maxRecordLength = 1 << 24
+
+//ErrNoPeerIndex is returned for a RIB record read before any PEER_INDEX_TABLE
+var ErrNoPeerIndex = errors.New("RIB record before PEER_INDEX_TABLE")
+
+//ErrInvalidRecord is returned for a truncated or inconsistent record
+type ErrInvalidRecord struct {
+	Type, Subtype uint16
+	Reason        string
+}
+
+func (e ErrInvalidRecord) Error() string {
+	return fmt.Sprintf("Invalid MRT record %v/%v: %v", e.Type, e.Subtype, e.Reason)
+}
+
+//Peer is a BGP peer of the collector, from the PEER_INDEX_TABLE
+type Peer struct {
+	BGPID net.IP
+	IP    net.IP
+	AS    uint32
+}
+
+//Segment is one segment of an AS path
+type Segment struct {
+	Type byte
+	ASNs []uint32
+}
+
+//Entry is the route to a prefix as received from one peer
+type Entry struct {
+	Peer       Peer
+	Originated time.Time
+	Origin     byte
+	ASPath     []Segment
+	//OriginAS is the last AS of the path, or 0 if the path is empty or ends in an AS_SET
+	OriginAS    uint32
+	NextHop     net.IP
+	Communities []uint32
+}
+
+//RIB is a prefix and its routes from every peer
+type RIB struct {
+	Sequence uint32
+	Prefix   net.IPNet
+	Entries  []Entry
+}
+
+//Reader reads RIB records one at a time, skipping records of other types
+type Reader struct {
+	r     io.Reader
+	peers []Peer
+	buf   []byte
+}
+
+//NewReader returns a Reader reading an MRT dump from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+//Peers returns the peers from the most recent PEER_INDEX_TABLE
+func (r *Reader) Peers() []Peer {
+	return r.peers
+}
+
+//Next returns the next RIB record, or io.EOF at the end of the dump
+func (r *Reader) Next() (*RIB, error) {
+	for {
+		var header [12]byte
+		if _, err := io.ReadFull(r.r, header[:]); err != nil {
+			return nil, err
+		}
+		typ := binary.BigEndian.Uint16(header[4:])
+		subtype := binary.BigEndian.Uint16(header[6:])
+		length := binary.BigEndian.Uint32(header[8:])
+		if length > maxRecordLength {
+			return nil, ErrInvalidRecord{typ, subtype, "too long"}
+		}
+
+		if typ != TypeTableDumpV2 || subtype != SubtypePeerIndexTable &&
+			subtype != SubtypeRIBIPv4Unicast && subtype != SubtypeRIBIPv6Unicast {
+			if _, err := io.CopyN(io.Discard, r.r, int64(length)); err != nil {
+				return nil, unexpected(err)
+			}
+			continue
+		}
+
+		//Reuse the buffer, so only one record is held at a time
+		if cap(r.buf) < int(length) {
+			r.buf = make([]byte, length)
+		}
+		data := r.buf[:length]
+		if _, err := io.ReadFull(r.r, data); err != nil {
+			return nil, unexpected(err)
+		}
+
+		d := decoder{data: data}
+		if subtype == SubtypePeerIndexTable {
+			peers := d.peerIndex()
+			if d.err != "" {
+				return nil, ErrInvalidRecord{typ, subtype, d.err}
+			}
+			r.peers = peers
+			continue
+		}
+
+		if r.peers == nil {
+			return nil, ErrNoPeerIndex
+		}
+		iplen := net.IPv4len
+		if subtype == SubtypeRIBIPv6Unicast {
+			iplen = net.IPv6len
+		}
+		rib := d.rib(iplen, r.peers)
+		if d.err != "" {
+			return nil, ErrInvalidRecord{typ, subtype, d.err}
+		}
+		return rib, nil
+	}
+}
+
+//unexpected turns EOF in the middle of a record into ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+//Load reads every RIB record of an MRT dump into an IPv4 and an IPv6 tree.
+//Values are []Entry. Roots have a nil value unless the dump has a default route
+func Load(in io.Reader) (v4, v6 iptree.Root, err error) {
+	v4 = iptree.NewDefaultRoot(net.IPv4len, nil)
+	v6 = iptree.NewDefaultRoot(net.IPv6len, nil)
+	r := NewReader(in)
+	for {
+		rib, err := r.Next()
+		if err == io.EOF {
+			return v4, v6, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		tree := v4
+		if len(rib.Prefix.IP) == net.IPv6len {
+			tree = v6
+		}
+		if err := tree.Insert(rib.Prefix, rib.Entries); err != nil {
+			return nil, nil, err
+		}
+	}
+}
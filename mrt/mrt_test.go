@@ -0,0 +1,181 @@
+package mrt_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"iptree/mrt"
+)
+
+//dump builds MRT records in memory
+type dump struct {
+	bytes.Buffer
+}
+
+func (d *dump) record(typ, subtype uint16, body []byte) {
+	d.Write(be(uint32(1600000000), typ, subtype, uint32(len(body))))
+	d.Write(body)
+}
+
+func be(values ...interface{}) []byte {
+	var b bytes.Buffer
+	for _, v := range values {
+		switch v := v.(type) {
+		case []byte:
+			b.Write(v)
+		case net.IP:
+			b.Write(v)
+		default:
+			binary.Write(&b, binary.BigEndian, v)
+		}
+	}
+	return b.Bytes()
+}
+
+func (d *dump) peerIndex() {
+	d.record(mrt.TypeTableDumpV2, mrt.SubtypePeerIndexTable, be(
+		net.IP{192, 0, 2, 255}, uint16(4), []byte("test"), uint16(2),
+		//IPv4 peer with a 2 byte AS
+		uint8(0), net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 1}, uint16(64500),
+		//IPv6 peer with a 4 byte AS
+		uint8(3), net.IP{192, 0, 2, 2}, net.ParseIP("2001:db8::2"), uint32(4200000000),
+	))
+}
+
+//attrs returns ORIGIN, AS_PATH and optionally NEXT_HOP and COMMUNITIES attributes
+func attrs(path []uint32, set []uint32, nexthop net.IP, communities ...uint32) []byte {
+	var seg []interface{}
+	seg = append(seg, uint8(mrt.ASSequence), uint8(len(path)))
+	for _, as := range path {
+		seg = append(seg, as)
+	}
+	if set != nil {
+		seg = append(seg, uint8(mrt.ASSet), uint8(len(set)))
+		for _, as := range set {
+			seg = append(seg, as)
+		}
+	}
+	aspath := be(seg...)
+
+	b := be(uint8(0x40), uint8(1), uint8(1), uint8(mrt.OriginIGP),
+		//Extended length AS_PATH
+		uint8(0x50), uint8(2), uint16(len(aspath)), aspath)
+	if nexthop.To4() != nil {
+		b = append(b, be(uint8(0x40), uint8(3), uint8(4), nexthop.To4())...)
+	} else if nexthop != nil {
+		b = append(b, be(uint8(0x80), uint8(14), uint8(17), uint8(16), nexthop)...)
+	}
+	if len(communities) > 0 {
+		b = append(b, be(uint8(0xc0), uint8(8), uint8(4*len(communities)))...)
+		b = append(b, be(communities)...)
+	}
+	return b
+}
+
+func (d *dump) rib(subtype uint16, seq uint32, prefix string, entries ...[]byte) {
+	_, ipnet, _ := net.ParseCIDR(prefix)
+	ones, _ := ipnet.Mask.Size()
+	body := be(seq, uint8(ones), []byte(ipnet.IP[:(ones+7)/8]), uint16(len(entries)))
+	for _, e := range entries {
+		body = append(body, e...)
+	}
+	d.record(mrt.TypeTableDumpV2, subtype, body)
+}
+
+func entry(peer uint16, a []byte) []byte {
+	return be(peer, uint32(1500000000), uint16(len(a)), a)
+}
+
+func buildDump() *dump {
+	d := &dump{}
+	//An unrelated record (BGP4MP) to be skipped
+	d.record(16, 4, []byte{1, 2, 3})
+	d.peerIndex()
+	d.rib(mrt.SubtypeRIBIPv4Unicast, 0, "10.0.0.0/8",
+		entry(0, attrs([]uint32{64500, 64501}, nil, net.IP{192, 0, 2, 1}, 64500<<16|100)),
+		entry(1, attrs([]uint32{4200000000, 64502, 64501}, nil, nil)))
+	d.rib(mrt.SubtypeRIBIPv4Unicast, 1, "10.1.128.0/17",
+		entry(0, attrs([]uint32{64500}, []uint32{64510, 64511}, net.IP{192, 0, 2, 1})))
+	d.rib(mrt.SubtypeRIBIPv6Unicast, 2, "2001:db8::/32",
+		entry(1, attrs([]uint32{4200000000, 64496}, nil, net.ParseIP("2001:db8::2"))))
+	d.rib(mrt.SubtypeRIBIPv4Unicast, 3, "0.0.0.0/0",
+		entry(0, attrs([]uint32{64500}, nil, net.IP{192, 0, 2, 1})))
+	return d
+}
+
+func entriesString(entries []mrt.Entry) string {
+	var s []string
+	for _, e := range entries {
+		s = append(s, fmt.Sprintf("peer=%v/%v path=%v origin=%v nh=%v comm=%v", e.Peer.IP, e.Peer.AS, e.ASPath, e.OriginAS, e.NextHop, e.Communities))
+	}
+	return strings.Join(s, "; ")
+}
+
+func TestReader(t *testing.T) {
+	r := mrt.NewReader(bytes.NewReader(buildDump().Bytes()))
+	got := ""
+	for {
+		rib, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got += fmt.Sprintf("%v %v: %v\n", rib.Sequence, rib.Prefix.String(), entriesString(rib.Entries))
+	}
+	want := `0 10.0.0.0/8: peer=192.0.2.1/64500 path=[{2 [64500 64501]}] origin=64501 nh=192.0.2.1 comm=[4227072100]; peer=2001:db8::2/4200000000 path=[{2 [4200000000 64502 64501]}] origin=64501 nh=<nil> comm=[]
+1 10.1.128.0/17: peer=192.0.2.1/64500 path=[{2 [64500]} {1 [64510 64511]}] origin=0 nh=192.0.2.1 comm=[]
+2 2001:db8::/32: peer=2001:db8::2/4200000000 path=[{2 [4200000000 64496]}] origin=64496 nh=2001:db8::2 comm=[]
+3 0.0.0.0/0: peer=192.0.2.1/64500 path=[{2 [64500]}] origin=64500 nh=192.0.2.1 comm=[]
+`
+	if got != want {
+		t.Error(got)
+	}
+	if len(r.Peers()) != 2 {
+		t.Error(r.Peers())
+	}
+}
+
+func TestLoad(t *testing.T) {
+	v4, v6, err := mrt.Load(bytes.NewReader(buildDump().Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v4.Count() != 3 || v6.Count() != 2 {
+		t.Errorf("v4: %v, v6: %v", v4.Count(), v6.Count())
+	}
+	value, err := v4.Find(net.IPNet{IP: net.IP{10, 1, 200, 1}, Mask: net.CIDRMask(32, 32)}, true)
+	if entries, ok := value.([]mrt.Entry); err != nil || !ok || len(entries) != 1 || entries[0].ASPath[1].Type != mrt.ASSet {
+		t.Errorf("Error: %v, v: %v", err, value)
+	}
+	value, err = v6.Find(net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(128, 128)}, true)
+	if entries, ok := value.([]mrt.Entry); err != nil || !ok || entries[0].OriginAS != 64496 {
+		t.Errorf("Error: %v, v: %v", err, value)
+	}
+
+	//RIB before the peer index (expect error)
+	d := &dump{}
+	d.rib(mrt.SubtypeRIBIPv4Unicast, 0, "10.0.0.0/8", entry(0, attrs([]uint32{1}, nil, nil)))
+	if _, _, err := mrt.Load(bytes.NewReader(d.Bytes())); err != mrt.ErrNoPeerIndex {
+		t.Error(err)
+	}
+
+	//Unknown peer and truncated records (expect errors)
+	d = &dump{}
+	d.peerIndex()
+	d.rib(mrt.SubtypeRIBIPv4Unicast, 0, "10.0.0.0/8", entry(7, attrs([]uint32{1}, nil, nil)))
+	if _, _, err := mrt.Load(bytes.NewReader(d.Bytes())); err == nil {
+		t.Error(err)
+	} else if _, ok := err.(mrt.ErrInvalidRecord); !ok {
+		t.Error(err)
+	}
+	data := buildDump().Bytes()
+	if _, _, err := mrt.Load(bytes.NewReader(data[:len(data)-3])); err != io.ErrUnexpectedEOF {
+		t.Error(err)
+	}
+}
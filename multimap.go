@@ -0,0 +1,199 @@
+package iptree
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+)
+
+//Multimap is a Root where every element holds a set of values, stored as a []interface{}.
+//Values are compared with reflect.DeepEqual. Elements are removed once their last value is,
+//except the root, which is kept with no values.
+//Insert and Update on the embedded Root replace the whole set, and must be given a []interface{}.
+type Multimap struct {
+	Root
+}
+
+//NewMultimap returns a Multimap using root, whose value must be nil or a []interface{}
+func NewMultimap(root Root) *Multimap {
+	return &Multimap{root}
+}
+
+//Add adds value to the set at IPNet, creating the element if needed.
+//Adding a value already in the set does nothing.
+//If a new root is created, ErrNewRoot contains a Multimap
+func (m *Multimap) Add(ipnet net.IPNet, value interface{}) error {
+	var verr error
+	err := Update(m.Root, ipnet, func(old interface{}, exists bool) (interface{}, bool) {
+		values, ok := old.([]interface{})
+		if old != nil && !ok {
+			verr = ErrValueType
+			return old, exists
+		}
+		if indexOfValue(values, value) >= 0 {
+			return values, true
+		}
+		added := make([]interface{}, len(values), len(values)+1)
+		copy(added, values)
+		return append(added, value), true
+	})
+	if verr != nil {
+		return verr
+	}
+	return m.wrapRoots(err)
+}
+
+//RemoveValue removes value from the set at IPNet.
+//If the element or the value does not exist, returns ErrNotFound
+func (m *Multimap) RemoveValue(ipnet net.IPNet, value interface{}) error {
+	isRoot := false
+	if base := baseNode(m.Root); base != nil && sameIPLen(base.IPNet, ipnet) {
+		isRoot = sameIP(base.IP, ipnet.IP) && compareMask(base.Mask, ipnet.Mask) == 0
+	}
+
+	found := false
+	var verr error
+	err := Update(m.Root, ipnet, func(old interface{}, exists bool) (interface{}, bool) {
+		values, ok := old.([]interface{})
+		if old != nil && !ok {
+			verr = ErrValueType
+			return old, exists
+		}
+		i := indexOfValue(values, value)
+		if i < 0 {
+			return old, exists
+		}
+		found = true
+		if len(values) == 1 && !isRoot {
+			return nil, false
+		}
+		removed := make([]interface{}, 0, len(values)-1)
+		removed = append(removed, values[:i]...)
+		return append(removed, values[i+1:]...), true
+	})
+	if verr != nil {
+		return verr
+	}
+	if err != nil {
+		return m.wrapRoots(err)
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+//Values returns the set at IPNet, which must match exactly
+func (m *Multimap) Values(ipnet net.IPNet) ([]interface{}, error) {
+	v, err := m.Root.Find(ipnet, false)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := v.([]interface{})
+	if v != nil && !ok {
+		return nil, ErrValueType
+	}
+	return append([]interface{}(nil), values...), nil
+}
+
+func (m *Multimap) FindMatch(ipnet net.IPNet, allowSupernet bool) (net.IPNet, interface{}, error) {
+	return FindMatch(m.Root, ipnet, allowSupernet)
+}
+
+//mutate passes m to the embedded Root, so wrappers around a Multimap see its Events
+func (m *Multimap) mutate(mu mutation, c *changeLog) error {
+	return m.wrapRoots(mutate(m.Root, mu, c))
+}
+
+//wrapRoots makes any new roots in err Multimaps
+func (m *Multimap) wrapRoots(err error) error {
+	switch e := err.(type) {
+	case ErrNewRoot:
+		return ErrNewRoot{&Multimap{e.NewRoot}}
+	case ErrRemovedRoot:
+		for i, r := range e.NewRoots {
+			e.NewRoots[i] = &Multimap{r}
+		}
+		return e
+	}
+	return err
+}
+
+func (m *Multimap) unwrap() Root {
+	return m.Root
+}
+
+func (m *Multimap) rewrap(root Root, ops []txOp, events []Event) (Root, error) {
+	return &Multimap{root}, nil
+}
+
+//indexOfValue returns the index of value in values, or -1
+func indexOfValue(values []interface{}, value interface{}) int {
+	for i, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return i
+		}
+	}
+	return -1
+}
+
+//MultiValueSerializer returns a ValueSerializer for the sets of a Multimap,
+//which uses serializer for every value in a set
+func MultiValueSerializer(serializer ValueSerializer) ValueSerializer {
+	return func(value interface{}) ([]byte, error) {
+		values, ok := value.([]interface{})
+		if value != nil && !ok {
+			return nil, ErrValueType
+		}
+		if len(values) > 0xffff {
+			return nil, ErrValueTooLarge
+		}
+
+		vbytes := make([]byte, 2, 2+4*len(values))
+		binary.BigEndian.PutUint16(vbytes, uint16(len(values)))
+		for _, v := range values {
+			b, err := serializer(v)
+			if err != nil {
+				return nil, err
+			}
+			if len(b) > 0xffff {
+				return nil, ErrValueTooLarge
+			}
+			vbytes = append(vbytes, byte(len(b)>>8), byte(len(b)))
+			vbytes = append(vbytes, b...)
+		}
+		return vbytes, nil
+	}
+}
+
+//MultiValueDeserializer returns a ValueDeserializer for sets written by MultiValueSerializer
+func MultiValueDeserializer(deserializer ValueDeserializer) ValueDeserializer {
+	return func(vbytes []byte) (interface{}, error) {
+		if len(vbytes) < 2 {
+			return nil, ErrInvalidData
+		}
+		count := int(binary.BigEndian.Uint16(vbytes))
+		vbytes = vbytes[2:]
+
+		values := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			if len(vbytes) < 2 {
+				return nil, ErrInvalidData
+			}
+			vlen := int(binary.BigEndian.Uint16(vbytes))
+			if len(vbytes) < 2+vlen {
+				return nil, ErrInvalidData
+			}
+			v, err := deserializer(vbytes[2 : 2+vlen])
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			vbytes = vbytes[2+vlen:]
+		}
+		if len(vbytes) != 0 {
+			return nil, ErrInvalidData
+		}
+		return values, nil
+	}
+}
@@ -0,0 +1,117 @@
+package iptree_test
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"iptree"
+)
+
+func TestMultimap(t *testing.T) {
+	m := iptree.NewMultimap(iptree.NewDefaultRoot(net.IPv4len, nil))
+	_, ten, _ := net.ParseCIDR("10.0.0.0/8")
+	_, ten1, _ := net.ParseCIDR("10.1.0.0/16")
+
+	//Add creates the element, and adding the same value twice does nothing
+	for _, v := range []string{"a", "b", "a"} {
+		if err := m.Add(*ten, v); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := m.Add(*ten1, "c"); err != nil {
+		t.Error(err)
+	}
+	if v, err := m.Values(*ten); err != nil || !reflect.DeepEqual(v, []interface{}{"a", "b"}) {
+		t.Errorf("Error: %v, v: %v", err, v)
+	}
+
+	//A value not in the set, or an element not in the tree (expect error)
+	if err := m.RemoveValue(*ten, "z"); err != iptree.ErrNotFound {
+		t.Error(err)
+	}
+	_, other, _ := net.ParseCIDR("172.16.0.0/12")
+	if err := m.RemoveValue(*other, "a"); err != iptree.ErrNotFound {
+		t.Error(err)
+	}
+
+	//Removing the last value removes the element, keeping its children
+	for _, v := range []string{"a", "b"} {
+		if err := m.RemoveValue(*ten, v); err != nil {
+			t.Error(err)
+		}
+	}
+	if v, err := m.Values(*ten); err != iptree.ErrNotFound {
+		t.Errorf("Error: %v, v: %v", err, v)
+	}
+	if v, err := m.Values(*ten1); err != nil || !reflect.DeepEqual(v, []interface{}{"c"}) {
+		t.Errorf("Error: %v, v: %v", err, v)
+	}
+
+	//The root is kept with no values
+	_, root, _ := net.ParseCIDR("0.0.0.0/0")
+	if err := m.Add(*root, "r"); err != nil {
+		t.Error(err)
+	}
+	if err := m.RemoveValue(*root, "r"); err != nil {
+		t.Error(err)
+	}
+	if v, err := m.Values(*root); err != nil || len(v) != 0 {
+		t.Errorf("Error: %v, v: %v", err, v)
+	}
+
+	//A value that is not a set (expect error)
+	if err := m.Insert(*ten, "not a set"); err != nil {
+		t.Error(err)
+	}
+	if err := m.Add(*ten, "a"); err != iptree.ErrValueType {
+		t.Error(err)
+	}
+
+	//A new root is a Multimap
+	m2 := iptree.NewMultimap(iptree.NewRoot(*ten1, nil))
+	err := m2.Add(*ten, "a")
+	nr, ok := err.(iptree.ErrNewRoot)
+	if !ok {
+		t.Fatal(err)
+	}
+	if _, ok := nr.NewRoot.(*iptree.Multimap); !ok {
+		t.Errorf("%T", nr.NewRoot)
+	}
+}
+
+func TestMultiValueSerializer(t *testing.T) {
+	m := iptree.NewMultimap(iptree.NewDefaultRoot(net.IPv4len, nil))
+	_, ten, _ := net.ParseCIDR("10.0.0.0/8")
+	for _, v := range []string{"a", "", "ccc"} {
+		if err := m.Add(*ten, v); err != nil {
+			t.Error(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := iptree.Serialize(m, &buf, iptree.MultiValueSerializer(iptree.NilAwareSerializer(iptree.StringSerializer))); err != nil {
+		t.Fatal(err)
+	}
+	tree, err := iptree.Deserialize(&buf, iptree.MultiValueDeserializer(iptree.NilAwareDeserializer(iptree.StringDeserializer)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := iptree.NewMultimap(tree).Values(*ten); err != nil || !reflect.DeepEqual(v, []interface{}{"a", "", "ccc"}) {
+		t.Errorf("Error: %v, v: %v", err, v)
+	}
+
+	//Truncated or trailing bytes (expect error)
+	deserializer := iptree.MultiValueDeserializer(iptree.StringDeserializer)
+	for _, b := range [][]byte{{0}, {0, 1, 0, 2, 'a'}, {0, 0, 0}} {
+		if v, err := deserializer(b); err != iptree.ErrInvalidData {
+			t.Errorf("Error: %v, v: %v", err, v)
+		}
+	}
+
+	//A value that is not a set (expect error)
+	if _, err := iptree.MultiValueSerializer(iptree.StringSerializer)("a"); err != iptree.ErrValueType {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,323 @@
+package iptree
+
+import (
+	"net"
+	"reflect"
+)
+
+//mop - mutation operations, applied to a tree with mutate
+const (
+	mopUpdate byte = iota + 1
+	mopRemove
+	mopRemoveSubtree
+	mopRemoveIf
+	mopPrune
+)
+
+//mutation is a single operation that changes a tree
+type mutation struct {
+	op       byte
+	ipnet    net.IPNet //For every op except mopRemoveIf and mopPrune
+	updater  Updater   //For mopUpdate
+	pred     Predicate //For mopRemoveIf
+	maxDepth int       //For mopPrune
+	insert   bool      //Set for a mopUpdate made by Insert, rather than Update
+}
+
+//mutator is implemented by Roots that can apply a mutation and report the Events it caused
+//as they make it, so that wrappers never have to look at the tree themselves.
+//The tree in this package and every wrapper around it implement it.
+type mutator interface {
+	mutate(m mutation, c *changeLog) error
+}
+
+//changeLog collects the Events caused by a mutation. A nil *changeLog collects nothing.
+type changeLog struct {
+	events []Event
+}
+
+func (c *changeLog) add(e Event) {
+	if c != nil {
+		c.events = append(c.events, e)
+	}
+}
+
+//removedTree adds an EventRemoved for n and every descendant, in traversal order
+func (c *changeLog) removedTree(n *node) {
+	if c == nil {
+		return
+	}
+	n.traverseRecursively(func(ipnet net.IPNet, value interface{}, distance int) error {
+		c.add(Event{Type: EventRemoved, IPNet: ipnet, Value: value})
+		return nil
+	}, 0)
+}
+
+//moved adds an EventReparented for every node in children, which are now under parent
+func (c *changeLog) moved(children []*node, parent net.IPNet) {
+	for _, ch := range children {
+		c.add(Event{Type: EventReparented, IPNet: ch.IPNet, Value: ch.value, Parent: parent})
+	}
+}
+
+//setter returns an Updater that sets value, as used by Insert
+func setter(value interface{}) Updater {
+	return func(interface{}, bool) (interface{}, bool) {
+		return value, true
+	}
+}
+
+//insertion returns the mutation made by Insert
+func insertion(ipnet net.IPNet, value interface{}) mutation {
+	return mutation{op: mopUpdate, ipnet: ipnet, updater: setter(value), insert: true}
+}
+
+//mutate applies m to root, adding the Events it causes to c.
+//A Root from outside this package cannot report its changes, so when c is not nil the
+//whole tree is compared before and after the change instead.
+func mutate(root Root, m mutation, c *changeLog) error {
+	if mr, ok := root.(mutator); ok {
+		return mr.mutate(m, c)
+	}
+	if c == nil {
+		return applyMutation(root, m)
+	}
+
+	before, err := treeState(root)
+	if err != nil {
+		return err
+	}
+	err = applyMutation(root, m)
+	if !succeeded(err) {
+		return err
+	}
+	var after []elemState
+	switch e := err.(type) {
+	case ErrNewRoot:
+		after, _ = treeState(e.NewRoot)
+	case ErrRemovedRoot:
+		after, _ = treeState(e.NewRoots...)
+	default:
+		after, _ = treeState(root)
+	}
+	c.events = append(c.events, diffStates(before, after)...)
+	return err
+}
+
+//applyMutation applies m to root with its exported methods
+func applyMutation(root Root, m mutation) error {
+	switch m.op {
+	case mopUpdate:
+		return update(root, m.ipnet, m.updater)
+	case mopRemove:
+		return root.Remove(m.ipnet)
+	case mopRemoveSubtree:
+		return removeSubtree(root, m.ipnet)
+	case mopRemoveIf:
+		return removeIf(root, m.pred)
+	case mopPrune:
+		return prune(root, m.maxDepth)
+	}
+	panic("unknown mutation")
+}
+
+//elemState is an element and its parent, used to compare a tree before and after a change
+type elemState struct {
+	ipnet  net.IPNet
+	value  interface{}
+	parent net.IPNet
+}
+
+//treeState returns every element of roots, in traversal order, with its parent
+func treeState(roots ...Root) ([]elemState, error) {
+	var state []elemState
+	for _, root := range roots {
+		parents := make([]net.IPNet, 0, 10)
+		if err := root.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+			var parent net.IPNet
+			if distance > 0 {
+				parent = parents[distance-1]
+			}
+			parents = append(parents[:distance], ipnet)
+			state = append(state, elemState{ipnet, value, parent})
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+//diffStates returns the events that turn before into after.
+//Values are compared with reflect.DeepEqual, so replacing a value with an equal one sends no event.
+func diffStates(before, after []elemState) []Event {
+	afterByKey := make(map[string]elemState, len(after))
+	for _, e := range after {
+		afterByKey[netKey(e.ipnet)] = e
+	}
+	beforeKeys := make(map[string]bool, len(before))
+
+	var events []Event
+	for _, b := range before {
+		k := netKey(b.ipnet)
+		beforeKeys[k] = true
+		a, ok := afterByKey[k]
+		if !ok {
+			events = append(events, Event{Type: EventRemoved, IPNet: b.ipnet, Value: b.value})
+			continue
+		}
+		if !reflect.DeepEqual(a.value, b.value) {
+			events = append(events, Event{Type: EventValueChanged, IPNet: a.ipnet, Value: a.value, OldValue: b.value})
+		}
+		if netKey(a.parent) != netKey(b.parent) {
+			events = append(events, Event{Type: EventReparented, IPNet: a.ipnet, Value: a.value, Parent: a.parent})
+		}
+	}
+	for _, a := range after {
+		if !beforeKeys[netKey(a.ipnet)] {
+			events = append(events, Event{Type: EventInserted, IPNet: a.ipnet, Value: a.value})
+		}
+	}
+	return events
+}
+
+//update is the implimentation used for Update
+func update(root Root, ipnet net.IPNet, f Updater) error {
+	if u, ok := root.(Updatable); ok {
+		return u.Update(ipnet, f)
+	}
+
+	value, err := root.Find(ipnet, false)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	exists := err == nil
+	newValue, keep := f(value, exists)
+	if keep {
+		return root.Insert(ipnet, newValue)
+	}
+	if !exists {
+		return nil
+	}
+	return removeElement(root, ipnet)
+}
+
+//removeElement removes the element at ipnet from a Root outside this package, keeping its
+//children. Remove drops them, so they are inserted again afterwards.
+func removeElement(root Root, ipnet net.IPNet) error {
+	var children []elemState
+	if err := root.Traverse(func(e net.IPNet, value interface{}, distance int) error {
+		if sameIPLen(ipnet, e) && onPath(ipnet, e) && compareMask(ipnet.Mask, e.Mask) != 0 {
+			children = append(children, elemState{ipnet: e, value: value})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := root.Remove(ipnet); err != nil {
+		//A removed root leaves its children as new roots
+		return err
+	}
+	for _, ch := range children {
+		if err := root.Insert(ch.ipnet, ch.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//removeSubtree is the implimentation used for RemoveSubtree
+func removeSubtree(root Root, ipnet net.IPNet) error {
+	if r, ok := root.(SubtreeRemover); ok {
+		return r.RemoveSubtree(ipnet)
+	}
+	//Remove drops the subtree, except at the root, whose children it keeps as new roots
+	err := root.Remove(ipnet)
+	if _, ok := err.(ErrRemovedRoot); ok {
+		return ErrRemovedRoot{}
+	}
+	return err
+}
+
+//removeIf is the implimentation used for RemoveIf
+func removeIf(root Root, pred Predicate) error {
+	if r, ok := root.(ConditionalRemover); ok {
+		return r.RemoveIf(pred)
+	}
+
+	var matched []net.IPNet
+	if err := root.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+		if pred(ipnet, value) {
+			matched = append(matched, ipnet)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	//Deepest first, so the children moved up by each removal are never removed later.
+	//The root comes first in traversal order, so it is removed last.
+	for i := len(matched) - 1; i >= 0; i-- {
+		if err := removeElement(root, matched[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//prune is the implimentation used for Prune
+func prune(root Root, maxDepth int) error {
+	if r, ok := root.(Pruner); ok {
+		return r.Prune(maxDepth)
+	}
+	if maxDepth < 0 {
+		return ErrRemovedRoot{}
+	}
+
+	var tooDeep []net.IPNet
+	if err := root.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+		if distance == maxDepth+1 {
+			tooDeep = append(tooDeep, ipnet)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, ipnet := range tooDeep {
+		if err := root.Remove(ipnet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//findMatch is the implimentation used for FindMatch
+func findMatch(root Root, ipnet net.IPNet, allowSupernet bool) (net.IPNet, interface{}, error) {
+	if f, ok := root.(MatchFinder); ok {
+		return f.FindMatch(ipnet, allowSupernet)
+	}
+	if !allowSupernet {
+		value, err := root.Find(ipnet, false)
+		if err != nil {
+			return net.IPNet{}, nil, err
+		}
+		return ipnet, value, nil
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	if bits == 0 {
+		return net.IPNet{}, nil, ErrNonCanonicalMask
+	}
+	for ; ones >= 0; ones-- {
+		mask := net.CIDRMask(ones, bits)
+		candidate := net.IPNet{IP: ipnet.IP.Mask(mask), Mask: mask}
+		value, err := root.Find(candidate, false)
+		if err == nil {
+			return candidate, value, nil
+		} else if err != ErrNotFound {
+			return net.IPNet{}, nil, err
+		}
+	}
+	return net.IPNet{}, nil, ErrNotFound
+}
@@ -16,19 +16,65 @@ func makeNode(ipnet net.IPNet, value interface{}, children []*node) *node {
 }
 
 func (n *node) Find(ipnet net.IPNet, allowSupernet bool) (value interface{}, err error) {
+	_, value, err = n.FindMatch(ipnet, allowSupernet)
+	return
+}
+
+func (n *node) FindMatch(ipnet net.IPNet, allowSupernet bool) (match net.IPNet, value interface{}, err error) {
 	if !sameIPLen(n.IPNet, ipnet) {
-		return nil, ErrWrongIPLength
+		return net.IPNet{}, nil, ErrWrongIPLength
 	}
 
 	vnode, err := n.findNode(ipnet, allowSupernet)
 	if err != nil {
-		return nil, err
+		return net.IPNet{}, nil, err
 	}
 
-	return vnode.value, nil
+	return vnode.IPNet, vnode.value, nil
 }
 
 func (n *node) Insert(ipnet net.IPNet, value interface{}) error {
+	return n.update(ipnet, setter(value), nil)
+}
+
+func (n *node) Update(ipnet net.IPNet, f Updater) error {
+	return n.update(ipnet, f, nil)
+}
+
+func (n *node) Remove(ipnet net.IPNet) error {
+	return n.remove(ipnet, nil)
+}
+
+func (n *node) RemoveSubtree(ipnet net.IPNet) error {
+	return n.removeSubtree(ipnet, nil)
+}
+
+func (n *node) RemoveIf(pred Predicate) error {
+	return n.removeIf(pred, nil)
+}
+
+func (n *node) Prune(maxDepth int) error {
+	return n.prune(maxDepth, nil)
+}
+
+func (n *node) mutate(m mutation, c *changeLog) error {
+	switch m.op {
+	case mopUpdate:
+		return n.update(m.ipnet, m.updater, c)
+	case mopRemove:
+		return n.remove(m.ipnet, c)
+	case mopRemoveSubtree:
+		return n.removeSubtree(m.ipnet, c)
+	case mopRemoveIf:
+		return n.removeIf(m.pred, c)
+	case mopPrune:
+		return n.prune(m.maxDepth, c)
+	}
+	panic("unknown mutation")
+}
+
+//update is the implimentation used for Update
+func (n *node) update(ipnet net.IPNet, f Updater, c *changeLog) error {
 	if !sameIPLen(n.IPNet, ipnet) {
 		return ErrWrongIPLength
 	}
@@ -36,18 +82,36 @@ func (n *node) Insert(ipnet net.IPNet, value interface{}) error {
 	p, atIndex, nChildren, _, amChild, err := n.findForInsertion(ipnet)
 	if err == ErrNotFound && amChild {
 		//The node to be inserted can be a new root
+		value, keep := f(nil, false)
+		if !keep {
+			return nil
+		}
+		c.add(Event{Type: EventInserted, IPNet: ipnet, Value: value})
+		c.moved([]*node{n}, ipnet)
 		return ErrNewRoot{makeNode(ipnet, value, []*node{n})}
 	} else if err != nil {
 		return err
 	}
-	if atIndex == -1 { //p is the exact node, therefore overwrite value
+	if atIndex == -1 { //p is the exact node, therefore overwrite or remove it
+		value, keep := f(p.value, true)
+		if !keep {
+			return n.removeElement(ipnet, c)
+		}
+		c.add(Event{Type: EventValueChanged, IPNet: ipnet, Value: value, OldValue: p.value})
 		p.value = value
 		return nil
 	}
 
+	value, keep := f(nil, false)
+	if !keep {
+		return nil
+	}
+
 	lo := p.children[:atIndex]
 	move := p.children[atIndex : atIndex+nChildren]
 	hi := p.children[atIndex+nChildren:]
+	c.add(Event{Type: EventInserted, IPNet: ipnet, Value: value})
+	c.moved(move, ipnet)
 
 	newChild := makeNode(ipnet, value, move)
 	p.children = make([]*node, 0, len(lo)+len(hi)+1)
@@ -57,7 +121,8 @@ func (n *node) Insert(ipnet net.IPNet, value interface{}) error {
 	return nil
 }
 
-func (n *node) Remove(ipnet net.IPNet) error {
+//remove is the implimentation used for Remove
+func (n *node) remove(ipnet net.IPNet, c *changeLog) error {
 	if !sameIPLen(n.IPNet, ipnet) {
 		return ErrWrongIPLength
 	}
@@ -68,23 +133,42 @@ func (n *node) Remove(ipnet net.IPNet) error {
 	}
 
 	if p != nil {
-		oldLen := len(p.children)
-		if oldLen == 1 {
-			p.children = nil
-		} else {
-			p.children = append(p.children[:ci], p.children[ci+1:]...)
-		}
+		//Remove the node and everything beneath it from the parent
+		c.removedTree(rem)
+		p.children = spliceChildren(p.children, ci, nil)
+		return nil
+	}
+	return n.removeRoot(rem, c)
+}
+
+//removeElement removes a single element, moving its children up to its parent.
+//It is used by Update when the Updater returns false for keep.
+func (n *node) removeElement(ipnet net.IPNet, c *changeLog) error {
+	rem, p, ci, err := n.findForRemoval(ipnet, nil, 0)
+	if err != nil {
+		return err
+	}
 
+	if p != nil {
+		//Replace rem with its children, which keeps p.children sorted
+		c.add(Event{Type: EventRemoved, IPNet: rem.IPNet, Value: rem.value})
+		c.moved(rem.children, p.IPNet)
+		p.children = spliceChildren(p.children, ci, rem.children)
 		return nil
 	}
+	return n.removeRoot(rem, c)
+}
 
+//removeRoot returns ErrRemovedRoot with every child of n as a new root
+func (n *node) removeRoot(rem *node, c *changeLog) error {
 	//No parent was found, but no error means that the node to be removed is this node
 	//In otherwords, rem must be equal to n
 	if n != rem {
 		panic("n != rem in Remove function")
 	}
 
-	//Every child of this node is now a root
+	c.add(Event{Type: EventRemoved, IPNet: n.IPNet, Value: n.value})
+	c.moved(n.children, net.IPNet{})
 	newRoots := make([]Root, len(n.children))
 	for i, n := range n.children {
 		newRoots[i] = n
@@ -93,6 +177,95 @@ func (n *node) Remove(ipnet net.IPNet) error {
 	return ErrRemovedRoot{newRoots}
 }
 
+//removeSubtree is the implimentation used for RemoveSubtree
+func (n *node) removeSubtree(ipnet net.IPNet, c *changeLog) error {
+	if !sameIPLen(n.IPNet, ipnet) {
+		return ErrWrongIPLength
+	}
+
+	rem, p, ci, err := n.findForRemoval(ipnet, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	c.removedTree(rem)
+	if p == nil { //The whole tree is removed
+		return ErrRemovedRoot{}
+	}
+	p.children = spliceChildren(p.children, ci, nil)
+	return nil
+}
+
+//removeIf is the implimentation used for RemoveIf
+func (n *node) removeIf(pred Predicate, c *changeLog) error {
+	if pred(n.IPNet, n.value) {
+		c.add(Event{Type: EventRemoved, IPNet: n.IPNet, Value: n.value})
+		n.removeChildrenIf(pred, nil, true, c)
+		newRoots := make([]Root, len(n.children))
+		for i, ch := range n.children {
+			newRoots[i] = ch
+		}
+		return ErrRemovedRoot{newRoots}
+	}
+	n.removeChildrenIf(pred, n, false, c)
+	return nil
+}
+
+//removeChildrenIf is the implimentation used for RemoveIf, for every descendant of n.
+//Children of n that are kept end up under keptParent, the closest ancestor that is kept,
+//or become roots if it is nil. moved is true if keptParent is not n.
+func (n *node) removeChildrenIf(pred Predicate, keptParent *node, moved bool, c *changeLog) {
+	if len(n.children) == 0 {
+		return
+	}
+	var parent net.IPNet
+	if keptParent != nil {
+		parent = keptParent.IPNet
+	}
+	children := make([]*node, 0, len(n.children))
+	for _, ch := range n.children {
+		if pred(ch.IPNet, ch.value) {
+			c.add(Event{Type: EventRemoved, IPNet: ch.IPNet, Value: ch.value})
+			ch.removeChildrenIf(pred, keptParent, true, c)
+			children = append(children, ch.children...)
+			continue
+		}
+		if moved {
+			c.add(Event{Type: EventReparented, IPNet: ch.IPNet, Value: ch.value, Parent: parent})
+		}
+		ch.removeChildrenIf(pred, ch, false, c)
+		children = append(children, ch)
+	}
+	if len(children) == 0 {
+		children = nil
+	}
+	n.children = children
+}
+
+//prune is the implimentation used for Prune
+func (n *node) prune(maxDepth int, c *changeLog) error {
+	if maxDepth < 0 {
+		c.removedTree(n)
+		return ErrRemovedRoot{}
+	}
+	n.pruneChildren(maxDepth, c)
+	return nil
+}
+
+//pruneChildren removes every descendant of n further than maxDepth from it
+func (n *node) pruneChildren(maxDepth int, c *changeLog) {
+	if maxDepth == 0 {
+		for _, ch := range n.children {
+			c.removedTree(ch)
+		}
+		n.children = nil
+		return
+	}
+	for _, ch := range n.children {
+		ch.pruneChildren(maxDepth-1, c)
+	}
+}
+
 func (n *node) Traverse(f Traverser) error {
 	return n.traverseRecursively(f, 0)
 }
@@ -121,3 +294,49 @@ func (n *node) Count() int {
 	}
 	return count + 1
 }
+
+//treeBuilder builds a new tree from elements passed to add in traversal order,
+//such as from Traverse or decodeStream
+type treeBuilder struct {
+	root *node
+	//parents[d] is the most recent node seen at distance d
+	parents []*node
+}
+
+//add is a Traverser
+func (b *treeBuilder) add(ipnet net.IPNet, value interface{}, distance int) error {
+	if distance > len(b.parents) || (distance == 0) != (b.root == nil) {
+		return ErrInvalidData
+	}
+	newNode := makeNode(ipnet, value, nil)
+	b.parents = append(b.parents[:distance], newNode)
+	if distance == 0 {
+		b.root = newNode
+		return nil
+	}
+	//Elements arrive in order, so appending keeps children sorted
+	p := b.parents[distance-1]
+	p.children = append(p.children, newNode)
+	return nil
+}
+
+//copyTree returns a copy of every element in root. IPNets and values are shared with root.
+func copyTree(root Root) (*node, error) {
+	var b treeBuilder
+	if err := root.Traverse(b.add); err != nil {
+		return nil, err
+	}
+	return b.root, nil
+}
+
+//spliceChildren returns children with the element at index replaced by replacement
+func spliceChildren(children []*node, index int, replacement []*node) []*node {
+	if len(children) == 1 && len(replacement) == 0 {
+		return nil
+	}
+	spliced := make([]*node, 0, len(children)-1+len(replacement))
+	spliced = append(spliced, children[:index]...)
+	spliced = append(spliced, replacement...)
+	spliced = append(spliced, children[index+1:]...)
+	return spliced
+}
@@ -0,0 +1,169 @@
+//Package ratelimit throttles clients with token buckets, using the most specific prefix
+//matching each client in an iptree Root to decide its limit.
+package ratelimit
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"iptree"
+)
+
+//ErrLimitType is returned when the value of a matching prefix is not a Limit
+var ErrLimitType = errors.New("Value is not a Limit")
+
+//Limit is a token bucket spec, stored as the value of a prefix (as Limit or *Limit).
+//A nil value means clients of the prefix are not limited.
+type Limit struct {
+	//Rate tokens are added per second, up to Burst. Each request takes one token
+	Rate  float64
+	Burst int
+
+	//AggregateBits is the prefix length clients are grouped at, each group getting its own bucket.
+	//If it is not longer than the prefix holding the Limit, all clients of the prefix share one bucket
+	AggregateBits int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+//Limiter decides whether to allow requests from clients, using the Limits in its trees
+type Limiter struct {
+	//Now is the clock used to refill buckets. Set to time.Now by New
+	Now func() time.Time
+
+	//SweepInterval is how often Allow calls Sweep, so that buckets of clients that have
+	//gone away are dropped. Set to DefaultSweepInterval by New. If 0, only Sweep drops buckets
+	SweepInterval time.Duration
+
+	trees     []iptree.Root
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+//DefaultSweepInterval is the SweepInterval set by New
+const DefaultSweepInterval = time.Minute
+
+//New returns a Limiter using the Limits in trees. The first tree with the client's IP length
+//is used, so an IPv4 and an IPv6 tree may be given together, as with httpmw.Middleware.Trees
+func New(trees ...iptree.Root) *Limiter {
+	return &Limiter{
+		Now:           time.Now,
+		SweepInterval: DefaultSweepInterval,
+		trees:         trees,
+		buckets:       make(map[string]*bucket),
+	}
+}
+
+//Allow takes a token for ip, returning whether there was one and the prefix whose Limit applied.
+//Returns iptree.ErrWrongIPLength if there is no tree for ip
+func (l *Limiter) Allow(ip net.IP) (bool, net.IPNet, error) {
+	tree, ip := l.treeFor(ip)
+	if tree == nil {
+		return false, net.IPNet{}, iptree.ErrWrongIPLength
+	}
+	bits := len(ip) * 8
+
+	prefix, value, err := iptree.FindMatch(tree, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, true)
+	if err != nil {
+		return false, net.IPNet{}, err
+	}
+	var limit Limit
+	switch v := value.(type) {
+	case nil:
+		return true, prefix, nil
+	case Limit:
+		limit = v
+	case *Limit:
+		if v == nil {
+			return true, prefix, nil
+		}
+		limit = *v
+	default:
+		return false, prefix, ErrLimitType
+	}
+
+	//Group the client at AggregateBits, but never above the prefix itself
+	ones, _ := prefix.Mask.Size()
+	group := prefix
+	if limit.AggregateBits > ones {
+		agg := limit.AggregateBits
+		if agg > bits {
+			agg = bits
+		}
+		mask := net.CIDRMask(agg, bits)
+		group = net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+	key := prefix.String() + " " + group.String()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.Now()
+	if l.SweepInterval > 0 && now.Sub(l.lastSweep) >= l.SweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok || b.limit != limit {
+		//New bucket, or the Limit changed since it was made
+		b = &bucket{tokens: float64(limit.Burst), last: now, limit: limit}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		return false, prefix, nil
+	}
+	b.tokens--
+	return true, prefix, nil
+}
+
+//treeFor returns the first tree with the IP length of ip, and ip at that length.
+//IPv4 addresses are always of length 4, even if they were parsed as IPv4-mapped IPv6
+func (l *Limiter) treeFor(ip net.IP) (iptree.Root, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, tree := range l.trees {
+		if tree.GetIPLength() == len(ip) {
+			return tree, ip
+		}
+	}
+	return nil, ip
+}
+
+//Sweep drops buckets that have refilled completely, as they are the same as new ones.
+//Returns the number of buckets dropped
+func (l *Limiter) Sweep() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sweep(l.Now())
+}
+
+//sweep is the implimentation used for Sweep. l.mu must be held.
+func (l *Limiter) sweep(now time.Time) int {
+	l.lastSweep = now
+	dropped := 0
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.limit.Rate
+		if b.tokens > float64(b.limit.Burst) {
+			b.tokens = float64(b.limit.Burst)
+		}
+	}
+	b.last = now
+}
@@ -0,0 +1,146 @@
+package ratelimit_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"iptree"
+	"iptree/ratelimit"
+)
+
+func TestLimiter(t *testing.T) {
+	tree := iptree.NewDefaultRoot(net.IPv4len, ratelimit.Limit{Rate: 10, Burst: 2, AggregateBits: 24})
+	_, office, _ := net.ParseCIDR("192.168.0.0/16")
+	if err := tree.Insert(*office, &ratelimit.Limit{Rate: 1000, Burst: 5}); err != nil {
+		t.Fatal(err)
+	}
+	_, monitor, _ := net.ParseCIDR("192.168.99.0/24")
+	if err := tree.Insert(*monitor, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := ratelimit.New(tree)
+	l.Now = func() time.Time { return now }
+
+	allow := func(ip string) (int, string) {
+		count := 0
+		var prefix net.IPNet
+		for i := 0; i < 10; i++ {
+			ok, p, err := l.Allow(net.ParseIP(ip))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok {
+				count++
+			}
+			prefix = p
+		}
+		return count, prefix.String()
+	}
+
+	//Internet clients get a burst of 2 per /24
+	if n, p := allow("8.8.8.8"); n != 2 || p != "0.0.0.0/0" {
+		t.Errorf("n: %v, prefix: %v", n, p)
+	}
+	if n, _ := allow("8.8.8.9"); n != 0 {
+		t.Errorf("same /24, n: %v", n)
+	}
+	if n, _ := allow("8.8.9.8"); n != 2 {
+		t.Errorf("other /24, n: %v", n)
+	}
+
+	//The office shares one bucket of 5
+	if n, p := allow("192.168.1.1"); n != 5 || p != "192.168.0.0/16" {
+		t.Errorf("n: %v, prefix: %v", n, p)
+	}
+	if n, _ := allow("192.168.2.1"); n != 0 {
+		t.Errorf("n: %v", n)
+	}
+
+	//nil is unlimited
+	if n, p := allow("192.168.99.1"); n != 10 || p != "192.168.99.0/24" {
+		t.Errorf("n: %v, prefix: %v", n, p)
+	}
+
+	//100ms refills one token for the internet, all 5 for the office
+	now = now.Add(100 * time.Millisecond)
+	if n, _ := allow("8.8.8.8"); n != 1 {
+		t.Errorf("n: %v", n)
+	}
+	if n, _ := allow("192.168.1.1"); n != 5 {
+		t.Errorf("n: %v", n)
+	}
+
+	//After a second every bucket is full again and can be swept
+	now = now.Add(time.Second)
+	if n := l.Sweep(); n != 3 {
+		t.Errorf("swept: %v", n)
+	}
+
+	//Allow sweeps by itself once SweepInterval has passed
+	if ok, _, err := l.Allow(net.ParseIP("8.8.8.8")); !ok || err != nil {
+		t.Errorf("Error: %v, ok: %v", err, ok)
+	}
+	now = now.Add(ratelimit.DefaultSweepInterval)
+	if ok, _, err := l.Allow(net.ParseIP("8.8.9.8")); !ok || err != nil {
+		t.Errorf("Error: %v, ok: %v", err, ok)
+	}
+	if n := l.Sweep(); n != 0 {
+		t.Errorf("swept: %v", n)
+	}
+
+	//No IPv6 tree and wrong value type (expect errors)
+	if _, _, err := l.Allow(net.ParseIP("2001:db8::1")); err != iptree.ErrWrongIPLength {
+		t.Error(err)
+	}
+	if err := tree.Insert(*office, "fast"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := l.Allow(net.ParseIP("192.168.1.1")); err != ratelimit.ErrLimitType {
+		t.Error(err)
+	}
+}
+
+func TestLimiterAddressFamilies(t *testing.T) {
+	v4 := iptree.NewDefaultRoot(net.IPv4len, ratelimit.Limit{Rate: 1, Burst: 1})
+	v6 := iptree.NewDefaultRoot(net.IPv6len, ratelimit.Limit{Rate: 1, Burst: 2})
+
+	burst := func(l *ratelimit.Limiter, ip string) (int, string) {
+		count := 0
+		var prefix net.IPNet
+		for i := 0; i < 5; i++ {
+			ok, p, err := l.Allow(net.ParseIP(ip))
+			if err != nil {
+				t.Errorf("%v: %v", ip, err)
+				return 0, ""
+			}
+			if ok {
+				count++
+			}
+			prefix = p
+		}
+		return count, prefix.String()
+	}
+
+	//Each family uses its own tree
+	l := ratelimit.New(v4, v6)
+	if n, p := burst(l, "192.0.2.1"); n != 1 || p != "0.0.0.0/0" {
+		t.Errorf("n: %v, prefix: %v", n, p)
+	}
+	if n, p := burst(l, "2001:db8::1"); n != 2 || p != "::/0" {
+		t.Errorf("n: %v, prefix: %v", n, p)
+	}
+
+	//IPv4-mapped clients use the IPv4 tree, and share its bucket
+	if n, p := burst(l, "::ffff:192.0.2.2"); n != 0 || p != "0.0.0.0/0" {
+		t.Errorf("n: %v, prefix: %v", n, p)
+	}
+
+	//No tree for the client (expect error)
+	l = ratelimit.New(v6)
+	if _, _, err := l.Allow(net.ParseIP("192.0.2.1")); err != iptree.ErrWrongIPLength {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,217 @@
+package routing
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//ErrIPRouteFormat is returned for lines that are not in the format of `ip route show`
+type ErrIPRouteFormat struct {
+	Line int
+	Err  error
+}
+
+func (e ErrIPRouteFormat) Error() string {
+	return fmt.Sprintf("Invalid ip route on line %v: %v", e.Line, e.Err)
+}
+
+//ipRouteTypes are the route types iproute2 shows before the prefix
+var ipRouteTypes = map[string]bool{
+	"unicast": true, "local": true, "broadcast": true, "multicast": true, "anycast": true,
+	"blackhole": true, "unreachable": true, "prohibit": true, "throw": true, "nat": true,
+}
+
+//ipRouteFlags are the attributes iproute2 shows without a value
+var ipRouteFlags = map[string]bool{
+	"onlink": true, "linkdown": true, "dead": true, "pervasive": true, "notify": true,
+	"offload": true, "trap": true, "offload_failed": true, "rt_offload": true, "rt_trap": true,
+}
+
+//ReadIPRoute adds the routes in the format of `ip route show` or `ip -6 route show` from r to table.
+//iplen is the IP length of "default" routes that have no gateway to tell.
+//Multipath routes, with a "nexthop" line per path, are added as one route per path.
+//Routes that differ only in metric are kept apart, as the kernel does.
+func ReadIPRoute(r io.Reader, table *RouteTable, iplen int) error {
+	//The route of the current multipath group, and whether any of its paths have been added
+	var multipath *net.IPNet
+	var shared Route
+	paths := 0
+	//flush adds a multipath route that turned out to have no nexthop lines
+	flush := func(line int) error {
+		if multipath != nil && paths == 0 {
+			if err := table.add(*multipath, shared, sameKernelRoute); err != nil {
+				return ErrIPRouteFormat{line, err}
+			}
+		}
+		multipath = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	line := 1
+	for ; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "nexthop" {
+			if multipath == nil {
+				return ErrIPRouteFormat{line, errors.New("nexthop without a route")}
+			}
+			route := shared
+			route.Options = append([]Option(nil), shared.Options...)
+			if err := parseIPRouteAttrs(fields[1:], &route); err != nil {
+				return ErrIPRouteFormat{line, err}
+			}
+			if err := table.add(*multipath, route, sameKernelRoute); err != nil {
+				return ErrIPRouteFormat{line, err}
+			}
+			paths++
+			continue
+		}
+
+		if err := flush(line - 1); err != nil {
+			return err
+		}
+		prefix, route, err := parseIPRoute(fields, iplen)
+		if err != nil {
+			return ErrIPRouteFormat{line, err}
+		}
+		//A route without a gateway or device may be followed by its nexthop lines
+		if route.NextHop == nil && route.Interface == "" && route.Type == "" {
+			multipath, shared, paths = &prefix, route, 0
+			continue
+		}
+		if err := table.add(prefix, route, sameKernelRoute); err != nil {
+			return ErrIPRouteFormat{line, err}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return flush(line - 1)
+}
+
+//parseIPRoute parses a route line: an optional type, the prefix, then its attributes
+func parseIPRoute(fields []string, iplen int) (net.IPNet, Route, error) {
+	var route Route
+	if ipRouteTypes[fields[0]] {
+		if fields[0] != "unicast" {
+			route.Type = fields[0]
+		}
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return net.IPNet{}, route, errors.New("missing prefix")
+	}
+	dest := fields[0]
+	if err := parseIPRouteAttrs(fields[1:], &route); err != nil {
+		return net.IPNet{}, route, err
+	}
+
+	if dest == "default" {
+		if route.NextHop != nil {
+			if route.NextHop.To4() != nil {
+				iplen = net.IPv4len
+			} else {
+				iplen = net.IPv6len
+			}
+		}
+		return net.IPNet{IP: make(net.IP, iplen), Mask: make(net.IPMask, iplen)}, route, nil
+	}
+	if !strings.Contains(dest, "/") {
+		//A host route
+		ip := net.ParseIP(dest)
+		if ip == nil {
+			return net.IPNet{}, route, fmt.Errorf("invalid prefix %q", dest)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, route, nil
+	}
+	_, prefix, err := net.ParseCIDR(dest)
+	if err != nil {
+		return net.IPNet{}, route, err
+	}
+	return *prefix, route, nil
+}
+
+//parseIPRouteAttrs parses keyword and value pairs into route
+func parseIPRouteAttrs(fields []string, route *Route) error {
+	for i := 0; i < len(fields); i++ {
+		key := fields[i]
+		if ipRouteFlags[key] {
+			route.setOption(key, "")
+			continue
+		}
+		if i+1 >= len(fields) {
+			return fmt.Errorf("missing value for %q", key)
+		}
+		i++
+		value := fields[i]
+
+		var err error
+		switch key {
+		case "via":
+			//The gateway may be given with its family, as in "via inet6 fe80::1"
+			if (value == "inet" || value == "inet6") && i+1 < len(fields) {
+				i++
+				value = fields[i]
+			}
+			if route.NextHop = net.ParseIP(value); route.NextHop == nil {
+				return fmt.Errorf("invalid gateway %q", value)
+			}
+			if ip4 := route.NextHop.To4(); ip4 != nil {
+				route.NextHop = ip4
+			}
+		case "src":
+			if route.Src = net.ParseIP(value); route.Src == nil {
+				return fmt.Errorf("invalid source %q", value)
+			}
+		case "dev":
+			route.Interface = value
+		case "proto":
+			route.Protocol = Protocol(value)
+		case "table":
+			route.Table = value
+		case "scope":
+			route.Scope = value
+		case "metric":
+			route.Metric, err = strconv.Atoi(value)
+		case "weight":
+			route.Weight, err = strconv.Atoi(value)
+		case "mtu":
+			//A locked MTU is shown as "mtu lock 1400"
+			if value == "lock" && i+1 < len(fields) {
+				route.setOption("mtu lock", "")
+				i++
+				value = fields[i]
+			}
+			route.MTU, err = strconv.Atoi(value)
+		default:
+			route.setOption(key, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//setOption sets the Option with key, replacing any it already has
+func (r *Route) setOption(key, value string) {
+	for i, o := range r.Options {
+		if o.Key == key {
+			r.Options[i].Value = value
+			return
+		}
+	}
+	r.Options = append(r.Options, Option{key, value})
+}
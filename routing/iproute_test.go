@@ -0,0 +1,120 @@
+package routing_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"iptree/routing"
+)
+
+//ipRouteString shows every field that `ip route` sets
+func ipRouteString(t *testing.T, table *routing.RouteTable) string {
+	s := ""
+	err := table.Traverse(func(prefix net.IPNet, routes []routing.Route, distance int) error {
+		for _, r := range routes {
+			var opts []string
+			for _, o := range r.Options {
+				opts = append(opts, o.Key+"="+o.Value)
+			}
+			sort.Strings(opts)
+			s += fmt.Sprintf("%v%v type=%v via=%v dev=%v proto=%v metric=%v table=%v scope=%v src=%v weight=%v mtu=%v %v\n",
+				strings.Repeat(" ", distance), prefix.String(), r.Type, r.NextHop, r.Interface, r.Protocol,
+				r.Metric, r.Table, r.Scope, r.Src, r.Weight, r.MTU, opts)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	return s
+}
+
+func TestReadIPRoute(t *testing.T) {
+	f, err := os.Open("testdata/ip_route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	table := routing.New()
+	if err := routing.ReadIPRoute(f, table, net.IPv4len); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `0.0.0.0/0 type= via=192.168.1.1 dev=eth0 proto=dhcp metric=100 table= scope= src=192.168.1.50 weight=0 mtu=0 []
+0.0.0.0/0 type= via=192.168.1.1 dev=eth0 proto=dhcp metric=600 table= scope= src=192.168.1.50 weight=0 mtu=0 []
+ 10.0.0.0/8 type= via=<nil> dev=wg0 proto= metric=0 table= scope=link src=<nil> weight=0 mtu=0 []
+  10.20.0.0/16 type= via=192.168.1.2 dev=eth0 proto=static metric=20 table= scope= src=<nil> weight=1 mtu=0 []
+  10.20.0.0/16 type= via=192.168.1.3 dev=eth0 proto=static metric=20 table= scope= src=<nil> weight=2 mtu=0 [onlink=]
+  10.99.0.0/16 type=blackhole via=<nil> dev= proto=static metric=0 table= scope= src=<nil> weight=0 mtu=0 []
+ 127.0.0.1/32 type=local via=<nil> dev=lo proto=kernel metric=0 table=local scope=host src=127.0.0.1 weight=0 mtu=0 []
+ 172.17.0.0/16 type= via=<nil> dev=docker0 proto=kernel metric=0 table= scope=link src=172.17.0.1 weight=0 mtu=0 [linkdown=]
+ 192.168.1.0/24 type= via=<nil> dev=eth0 proto=kernel metric=100 table= scope=link src=192.168.1.50 weight=0 mtu=0 []
+  192.168.1.255/32 type=broadcast via=<nil> dev=eth0 proto=kernel metric=0 table=local scope=link src=192.168.1.50 weight=0 mtu=0 []
+ 192.168.10.10/32 type= via=192.168.1.1 dev=eth0 proto= metric=0 table= scope= src=<nil> weight=0 mtu=1400 [mtu lock=]
+ 203.0.113.0/24 type=unreachable via=<nil> dev= proto= metric=1024 table= scope= src=<nil> weight=0 mtu=0 []
+`
+	if got := ipRouteString(t, table); got != want {
+		t.Error(got)
+	}
+
+	//Both paths of the multipath route are selected
+	if _, routes, err := table.Lookup(net.ParseIP("10.20.1.1")); err != nil || len(routes) != 2 {
+		t.Errorf("Error: %v, v: %v", err, routes)
+	}
+}
+
+func TestReadIPv6Route(t *testing.T) {
+	f, err := os.Open("testdata/ip_6_route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	table := routing.New()
+	if err := routing.ReadIPRoute(f, table, net.IPv6len); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `::/0 type= via=fe80::1 dev=eth0 proto=ra metric=100 table= scope= src=<nil> weight=0 mtu=0 [expires=1797sec hoplimit=64 pref=medium]
+ ::1/128 type= via=<nil> dev=lo proto=kernel metric=256 table= scope= src=<nil> weight=0 mtu=0 [pref=medium]
+ 2001:db8:0:1::/64 type= via=<nil> dev=eth0 proto=ra metric=100 table= scope= src=<nil> weight=0 mtu=0 [expires=86363sec pref=medium]
+ 2001:db8:ffff::/48 type= via=2001:db8:0:1::fe dev=eth0 proto=static metric=1024 table= scope= src=<nil> weight=0 mtu=0 [pref=high]
+ fe80::/64 type= via=<nil> dev=eth0 proto=kernel metric=256 table= scope= src=<nil> weight=0 mtu=0 [pref=medium]
+ fe80::/64 type= via=<nil> dev=wg0 proto=kernel metric=256 table= scope= src=<nil> weight=0 mtu=0 [pref=medium]
+ ff00::/8 type=multicast via=<nil> dev=eth0 proto=kernel metric=256 table=local scope= src=<nil> weight=0 mtu=0 [pref=medium]
+`
+	if got := ipRouteString(t, table); got != want {
+		t.Error(got)
+	}
+}
+
+func TestReadIPRouteErrors(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		line int
+	}{
+		{"10.0.0.0/8 dev", 1},
+		{"10.0.0.0/33 dev eth0", 1},
+		{"default via 10.0.0.1 dev eth0\n\tnexthop via 10.0.0.2", 2},
+		{"\n10.0.0.0/8 via 10.0.0.300", 2},
+		{"10.0.0.0/8 dev eth0 metric high", 1},
+		{"unreachable", 1},
+	} {
+		err := routing.ReadIPRoute(strings.NewReader(c.text), routing.New(), net.IPv4len)
+		if e, ok := err.(routing.ErrIPRouteFormat); !ok || e.Line != c.line {
+			t.Errorf("%q: %v", c.text, err)
+		}
+	}
+
+	//A multipath route without nexthop lines is still added
+	table := routing.New()
+	if err := routing.ReadIPRoute(strings.NewReader("10.0.0.0/8 proto static"), table, net.IPv4len); err != nil {
+		t.Error(err)
+	}
+	if _, routes, err := table.Lookup(net.ParseIP("10.1.1.1")); err != nil || len(routes) != 1 {
+		t.Errorf("Error: %v, v: %v", err, routes)
+	}
+}
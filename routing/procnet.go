@@ -0,0 +1,250 @@
+package routing
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//Kernel route flags, as found in /proc/net/route and /proc/net/ipv6_route
+const (
+	RTFUp      uint32 = 0x0001
+	RTFGateway uint32 = 0x0002
+	RTFHost    uint32 = 0x0004
+	RTFReject  uint32 = 0x0200
+)
+
+//procRouteHeader is the first line of /proc/net/route, before padding
+const procRouteHeader = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT"
+
+//ErrProcFormat is returned for lines that are not in the /proc/net/route or /proc/net/ipv6_route format
+type ErrProcFormat struct {
+	Line int
+	Err  error
+}
+
+func (e ErrProcFormat) Error() string {
+	return fmt.Sprintf("Invalid route on line %v: %v", e.Line, e.Err)
+}
+
+var errProcFields = errors.New("wrong number of fields")
+
+//LoadKernelRoutes reads the routes of the running Linux kernel from /proc/net/route
+//and /proc/net/ipv6_route. Either file may be missing if the protocol is disabled
+func LoadKernelRoutes() (*RouteTable, error) {
+	table := New()
+	for path, read := range map[string]func(io.Reader, *RouteTable) error{
+		"/proc/net/route":      ReadProcRoute,
+		"/proc/net/ipv6_route": ReadProcIPv6Route,
+	} {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		err = read(f, table)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return table, nil
+}
+
+//ReadProcRoute adds the routes in /proc/net/route format from r to table.
+//Routes that differ only in metric are kept apart, as the kernel does. Routes with RTFReject,
+//which the kernel shows for blackhole, unreachable and prohibit routes alike, are TypeUnreachable.
+//Addresses are in the byte order of a little endian host, as written by the kernel on x86 and ARM
+func ReadProcRoute(r io.Reader, table *RouteTable) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || line == 1 && fields[0] == "Iface" {
+			continue
+		}
+		prefix, route, err := parseProcRoute(fields)
+		if err != nil {
+			return ErrProcFormat{line, err}
+		}
+		if err := table.add(prefix, route, sameKernelRoute); err != nil {
+			return ErrProcFormat{line, err}
+		}
+	}
+	return scanner.Err()
+}
+
+func parseProcRoute(fields []string) (net.IPNet, Route, error) {
+	if len(fields) != 11 {
+		return net.IPNet{}, Route{}, errProcFields
+	}
+	var hexes [4]uint64
+	for i, f := range []string{fields[1], fields[2], fields[7], fields[3]} {
+		v, err := strconv.ParseUint(f, 16, 32)
+		if err != nil {
+			return net.IPNet{}, Route{}, err
+		}
+		hexes[i] = v
+	}
+	var ints [4]int
+	for i, f := range []string{fields[6], fields[8], fields[9], fields[10]} {
+		v, err := strconv.Atoi(f)
+		if err != nil {
+			return net.IPNet{}, Route{}, err
+		}
+		ints[i] = v
+	}
+
+	route := Route{
+		Interface: fields[0],
+		Metric:    ints[0],
+		Protocol:  ProtoKernel,
+		Flags:     uint32(hexes[3]),
+		MTU:       ints[1],
+		Window:    ints[2],
+		IRTT:      ints[3],
+	}
+	if hexes[1] != 0 {
+		route.NextHop = procIP(uint32(hexes[1]))
+	}
+	if route.Flags&RTFReject != 0 {
+		route.Type = TypeUnreachable
+	}
+	return net.IPNet{IP: procIP(uint32(hexes[0])), Mask: net.IPMask(procIP(uint32(hexes[2])))}, route, nil
+}
+
+//procIP converts an address as read from /proc/net/route to an IP
+func procIP(v uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.LittleEndian.PutUint32(ip, v)
+	return ip
+}
+
+//WriteProcRoute writes the IPv4 routes of table in /proc/net/route format, in traversal order
+func WriteProcRoute(w io.Writer, table *RouteTable) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%-127s\n", procRouteHeader)
+	err := table.Traverse(func(prefix net.IPNet, routes []Route, distance int) error {
+		if len(prefix.IP) != net.IPv4len {
+			return nil
+		}
+		for _, r := range routes {
+			gateway := uint32(0)
+			if gw := r.NextHop.To4(); gw != nil {
+				gateway = binary.LittleEndian.Uint32(gw)
+			}
+			line := fmt.Sprintf("%s\t%08X\t%08X\t%04X\t%d\t%d\t%d\t%08X\t%d\t%d\t%d",
+				r.Interface, binary.LittleEndian.Uint32(prefix.IP), gateway, r.Flags, 0, 0,
+				r.Metric, binary.LittleEndian.Uint32(prefix.Mask), r.MTU, r.Window, r.IRTT)
+			if _, err := fmt.Fprintf(bw, "%-127s\n", line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+//ReadProcIPv6Route adds the routes in /proc/net/ipv6_route format from r to table.
+//Routes that differ only in metric are kept apart, as the kernel does, and routes with RTFReject
+//are TypeUnreachable.
+//Source prefixes (used by policy routing) are ignored
+func ReadProcIPv6Route(r io.Reader, table *RouteTable) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		prefix, route, err := parseProcIPv6Route(fields)
+		if err != nil {
+			return ErrProcFormat{line, err}
+		}
+		if err := table.add(prefix, route, sameKernelRoute); err != nil {
+			return ErrProcFormat{line, err}
+		}
+	}
+	return scanner.Err()
+}
+
+func parseProcIPv6Route(fields []string) (net.IPNet, Route, error) {
+	if len(fields) != 10 {
+		return net.IPNet{}, Route{}, errProcFields
+	}
+	var ips [2]net.IP
+	for i, f := range []string{fields[0], fields[4]} {
+		ip, err := hex.DecodeString(f)
+		if err != nil {
+			return net.IPNet{}, Route{}, err
+		}
+		if len(ip) != net.IPv6len {
+			return net.IPNet{}, Route{}, errProcFields
+		}
+		ips[i] = ip
+	}
+	var hexes [3]uint64
+	for i, f := range []string{fields[1], fields[5], fields[8]} {
+		v, err := strconv.ParseUint(f, 16, 32)
+		if err != nil {
+			return net.IPNet{}, Route{}, err
+		}
+		hexes[i] = v
+	}
+	if hexes[0] > 128 {
+		return net.IPNet{}, Route{}, errors.New("prefix length out of range")
+	}
+
+	route := Route{
+		Interface: fields[9],
+		Metric:    int(hexes[1]),
+		Protocol:  ProtoKernel,
+		Flags:     uint32(hexes[2]),
+	}
+	if !ips[1].IsUnspecified() {
+		route.NextHop = ips[1]
+	}
+	if route.Flags&RTFReject != 0 {
+		route.Type = TypeUnreachable
+	}
+	mask := net.CIDRMask(int(hexes[0]), 128)
+	return net.IPNet{IP: ips[0].Mask(mask), Mask: mask}, route, nil
+}
+
+//WriteProcIPv6Route writes the IPv6 routes of table in /proc/net/ipv6_route format, in traversal order.
+//IPv4-mapped prefixes are not written
+func WriteProcIPv6Route(w io.Writer, table *RouteTable) error {
+	bw := bufio.NewWriter(w)
+	zero := hex.EncodeToString(net.IPv6zero)
+	err := table.Traverse(func(prefix net.IPNet, routes []Route, distance int) error {
+		if len(prefix.IP) != net.IPv6len {
+			return nil
+		}
+		ones, _ := prefix.Mask.Size()
+		for _, r := range routes {
+			nexthop := zero
+			if len(r.NextHop) == net.IPv6len && r.NextHop.To4() == nil {
+				nexthop = hex.EncodeToString(r.NextHop)
+			}
+			_, err := fmt.Fprintf(bw, "%s %02x %s %02x %s %08x %08x %08x %08x %8s\n",
+				hex.EncodeToString(prefix.IP), ones, zero, 0, nexthop, uint32(r.Metric), 0, 0, r.Flags, r.Interface)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
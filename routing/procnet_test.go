@@ -0,0 +1,165 @@
+package routing_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"iptree"
+	"iptree/routing"
+)
+
+func tableString(t *testing.T, table *routing.RouteTable) string {
+	s := ""
+	err := table.Traverse(func(prefix net.IPNet, routes []routing.Route, distance int) error {
+		for _, r := range routes {
+			s += fmt.Sprintf("%v%v via %v dev %v metric %v flags %x mtu %v\n", strings.Repeat(" ", distance),
+				prefix.String(), r.NextHop, r.Interface, r.Metric, r.Flags, r.MTU)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	return s
+}
+
+func sortedLines(s string) []string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], " ")
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestProcRoute(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/proc_net_route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := routing.New()
+	if err := routing.ReadProcRoute(bytes.NewReader(fixture), table); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `0.0.0.0/0 via 192.168.1.1 dev eth0 metric 100 flags 3 mtu 0
+0.0.0.0/0 via 192.168.1.1 dev eth0 metric 600 flags 3 mtu 0
+ 10.0.0.0/8 via <nil> dev wg0 metric 0 flags 1 mtu 0
+  10.99.0.0/16 via <nil> dev * metric 0 flags 201 mtu 0
+ 172.17.0.0/16 via <nil> dev docker0 metric 0 flags 1 mtu 0
+ 192.168.1.0/24 via <nil> dev eth0 metric 100 flags 1 mtu 0
+ 192.168.10.10/32 via 192.168.1.1 dev eth0 metric 0 flags 7 mtu 1400
+`
+	if got := tableString(t, table); got != want {
+		t.Error(got)
+	}
+	if prefix, routes, err := table.Lookup(net.ParseIP("192.168.1.77")); err != nil || prefix.String() != "192.168.1.0/24" || routes[0].Interface != "eth0" {
+		t.Errorf("Error: %v, v: %v %v", err, prefix, routes)
+	}
+	//A reject route is unreachable
+	if prefix, routes, err := table.Lookup(net.ParseIP("10.99.1.1")); err != routing.ErrRejected || prefix.String() != "10.99.0.0/16" || routes[0].Type != routing.TypeUnreachable {
+		t.Errorf("Error: %v, v: %v %v", err, prefix, routes)
+	}
+
+	//Writing gives the same lines, in traversal order
+	var out bytes.Buffer
+	if err := routing.WriteProcRoute(&out, table); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedLines(out.String()), sortedLines(string(fixture)); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Error(out.String())
+	}
+	for _, line := range strings.SplitAfter(out.String(), "\n") {
+		if line != "" && len(line) != 128 {
+			t.Errorf("Unpadded line %q", line)
+		}
+	}
+
+	//Deleting with a metric only removes the route with that metric, without one removes every metric
+	_, def, _ := net.ParseCIDR("0.0.0.0/0")
+	gw := routing.Route{NextHop: net.ParseIP("192.168.1.1").To4(), Interface: "eth0", Protocol: routing.ProtoKernel, Metric: 600}
+	if err := table.Delete(*def, gw); err != nil {
+		t.Error(err)
+	}
+	if routes, err := table.Routes(*def); err != nil || len(routes) != 1 || routes[0].Metric != 100 {
+		t.Errorf("Error: %v, v: %v", err, routes)
+	}
+	if err := table.Delete(*def, gw); err != iptree.ErrNotFound {
+		t.Error(err)
+	}
+	gw.Metric = 0
+	if err := table.Delete(*def, gw); err != nil {
+		t.Error(err)
+	}
+	if _, err := table.Routes(*def); err != iptree.ErrNotFound {
+		t.Error(err)
+	}
+
+	//Bad lines (expect errors)
+	for _, bad := range []string{
+		"eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\n",
+		"eth0\t0000000G\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n",
+		"eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00FF00FF\t0\t0\t0\n",
+	} {
+		err := routing.ReadProcRoute(strings.NewReader(bad), routing.New())
+		if e, ok := err.(routing.ErrProcFormat); !ok || e.Line != 1 {
+			t.Errorf("%q: %v", bad, err)
+		}
+	}
+}
+
+func TestProcIPv6Route(t *testing.T) {
+	fixture, err := os.Open("testdata/proc_net_ipv6_route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fixture.Close()
+	table := routing.New()
+	if err := routing.ReadProcIPv6Route(fixture, table); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `::/0 via fe80::1 dev eth0 metric 1024 flags 450003 mtu 0
+ ::1/128 via <nil> dev lo metric 0 flags 80200001 mtu 0
+ 2001:db8::/64 via <nil> dev eth0 metric 256 flags 1 mtu 0
+ 2001:db9::/32 via <nil> dev lo metric 4294967295 flags 200200 mtu 0
+ fe80::/64 via <nil> dev eth0 metric 256 flags 1 mtu 0
+ fe80::/64 via <nil> dev wg0 metric 256 flags 1 mtu 0
+ ff00::/8 via <nil> dev eth0 metric 256 flags 1 mtu 0
+`
+	got := tableString(t, table)
+	if got != want {
+		t.Error(got)
+	}
+	//The kernel's unreachable routes are on lo, but reject traffic
+	if prefix, routes, err := table.Lookup(net.ParseIP("2001:db9::1")); err != routing.ErrRejected || prefix.String() != "2001:db9::/32" || routes[0].Type != routing.TypeUnreachable {
+		t.Errorf("Error: %v, v: %v %v", err, prefix, routes)
+	}
+
+	//Writing and reading back gives the same table
+	var out bytes.Buffer
+	if err := routing.WriteProcIPv6Route(&out, table); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000000 00000000 00450003     eth0\n") {
+		t.Error(out.String())
+	}
+	reread := routing.New()
+	if err := routing.ReadProcIPv6Route(&out, reread); err != nil {
+		t.Fatal(err)
+	}
+	if again := tableString(t, reread); again != got {
+		t.Error(again)
+	}
+
+	//Bad line (expect error)
+	err = routing.ReadProcIPv6Route(strings.NewReader("\nfe80 40 00 00 00 00000100 00000001 00000000 00000001 eth0\n"), routing.New())
+	if e, ok := err.(routing.ErrProcFormat); !ok || e.Line != 2 {
+		t.Error(err)
+	}
+}
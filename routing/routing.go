@@ -0,0 +1,347 @@
+//Package routing is a longest-prefix-match routing table built on iptree, holding several
+//routes per prefix with best route selection and ECMP.
+package routing
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+
+	"iptree"
+)
+
+//ErrNoRoute is returned when there is no route to a destination
+var ErrNoRoute = errors.New("No route to destination")
+
+//ErrInvalidPrefix is returned for a prefix that is neither IPv4 nor IPv6
+var ErrInvalidPrefix = errors.New("Invalid prefix")
+
+//ErrRejected is returned with the routes a lookup selected when they are blackhole,
+//unreachable or prohibit routes, so traffic to the destination is dropped
+var ErrRejected = errors.New("Route rejects destination")
+
+//Protocol is the source of a route
+type Protocol string
+
+//Common route sources
+const (
+	ProtoKernel    Protocol = "kernel"
+	ProtoConnected Protocol = "connected"
+	ProtoStatic    Protocol = "static"
+	ProtoOSPF      Protocol = "ospf"
+	ProtoBGP       Protocol = "bgp"
+	ProtoDHCP      Protocol = "dhcp"
+)
+
+//Tables that iproute2 shows by name
+const (
+	TableMain  = "main"
+	TableLocal = "local"
+)
+
+//Route types that change the result of a lookup. Every other type, including unicast,
+//is returned as a route to the destination
+const (
+	TypeBlackhole   = "blackhole"
+	TypeUnreachable = "unreachable"
+	TypeProhibit    = "prohibit"
+	TypeThrow       = "throw"
+)
+
+//Option is an iproute2 attribute of a Route
+type Option struct {
+	Key   string
+	Value string
+}
+
+//Route is one way of reaching a prefix.
+//Routes are not comparable with ==, as NextHop, Src and Options are slices
+type Route struct {
+	//NextHop is nil for directly connected routes
+	NextHop   net.IP
+	Interface string
+	Metric    int
+	//AdminDistance ranks sources against each other, lower is preferred
+	AdminDistance int
+	Protocol      Protocol
+
+	//Flags are the kernel RTF_ flags, as found in /proc/net/route
+	Flags uint32
+	//MTU, Window and IRTT are only found in /proc/net/route, and are usually 0
+	MTU    int
+	Window int
+	IRTT   int
+
+	//Type, Table, Scope, Src and Weight are as shown by iproute2. Type is empty for unicast
+	//routes, and Table is empty for routes in TableMain
+	Type   string
+	Table  string
+	Scope  string
+	Src    net.IP
+	Weight int
+	//Options are any other iproute2 attributes in the order they were read, with an empty
+	//Value for those that are only a flag
+	Options []Option
+}
+
+//Option returns the value of the Option with key, and whether there is one
+func (r Route) Option(key string) (string, bool) {
+	for _, o := range r.Options {
+		if o.Key == key {
+			return o.Value, true
+		}
+	}
+	return "", false
+}
+
+//inTable reports whether r is in table
+func (r Route) inTable(table string) bool {
+	if r.Table == "" {
+		return table == TableMain
+	}
+	return r.Table == table
+}
+
+//sameRoute reports whether a and b are the same path, from the same source.
+//Adding a route replaces the same route with different metrics
+func sameRoute(a, b Route) bool {
+	return a.NextHop.Equal(b.NextHop) && a.Interface == b.Interface && a.Protocol == b.Protocol &&
+		a.Type == b.Type && a.Table == b.Table
+}
+
+//sameKernelRoute reports whether a and b are the same kernel route. The kernel keeps routes
+//that differ only in metric apart, so importing them must not replace one with the other
+func sameKernelRoute(a, b Route) bool {
+	return sameRoute(a, b) && a.Metric == b.Metric
+}
+
+//better reports whether a is preferred over b
+func better(a, b Route) bool {
+	if a.AdminDistance != b.AdminDistance {
+		return a.AdminDistance < b.AdminDistance
+	}
+	return a.Metric < b.Metric
+}
+
+//RouteTable holds IPv4 and IPv6 routes. Every prefix holds a []Route, sorted with the
+//best routes first. It is safe for concurrent use
+type RouteTable struct {
+	mu sync.RWMutex
+	v4 iptree.Root
+	v6 iptree.Root
+}
+
+//New returns an empty RouteTable
+func New() *RouteTable {
+	return &RouteTable{
+		v4: iptree.NewDefaultRoot(net.IPv4len, nil),
+		v6: iptree.NewDefaultRoot(net.IPv6len, nil),
+	}
+}
+
+//tree returns the tree for prefix, with prefix normalised to its length and masked
+func (t *RouteTable) tree(prefix net.IPNet) (iptree.Root, net.IPNet, error) {
+	ones, bits := prefix.Mask.Size()
+	switch {
+	case bits == 0:
+		return nil, prefix, iptree.ErrNonCanonicalMask
+	case prefix.IP.To4() != nil && (bits == 32 || bits == 128 && ones >= 96):
+		if bits == 128 {
+			ones -= 96
+		}
+		mask := net.CIDRMask(ones, 32)
+		return t.v4, net.IPNet{IP: prefix.IP.To4().Mask(mask), Mask: mask}, nil
+	case len(prefix.IP) == net.IPv6len && bits == 128:
+		return t.v6, net.IPNet{IP: prefix.IP.Mask(prefix.Mask), Mask: prefix.Mask}, nil
+	}
+	return nil, prefix, ErrInvalidPrefix
+}
+
+//Add adds r to prefix, replacing any route with the same next hop, interface and protocol
+func (t *RouteTable) Add(prefix net.IPNet, r Route) error {
+	return t.add(prefix, r, sameRoute)
+}
+
+//add is the implimentation used for Add, replacing any route that same reports is r
+func (t *RouteTable) add(prefix net.IPNet, r Route, same func(a, b Route) bool) error {
+	tree, prefix, err := t.tree(prefix)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return iptree.Update(tree, prefix, func(value interface{}, exists bool) (interface{}, bool) {
+		routes, _ := value.([]Route)
+		//Copy, so slices returned to callers never change
+		updated := make([]Route, 0, len(routes)+1)
+		for _, old := range routes {
+			if !same(old, r) {
+				updated = append(updated, old)
+			}
+		}
+		updated = append(updated, r)
+		sort.SliceStable(updated, func(i, j int) bool {
+			return better(updated[i], updated[j])
+		})
+		return updated, true
+	})
+}
+
+//Delete removes r (matched by next hop, interface and protocol) from prefix. If r has a
+//metric, only routes with that metric are removed, so kernel routes that differ only in
+//metric can be deleted one at a time. Returns iptree.ErrNotFound if there is no such route
+func (t *RouteTable) Delete(prefix net.IPNet, r Route) error {
+	if r.Metric != 0 {
+		return t.delete(prefix, r, sameKernelRoute)
+	}
+	return t.delete(prefix, r, sameRoute)
+}
+
+//delete is the implimentation used for Delete, removing every route that same reports is r
+func (t *RouteTable) delete(prefix net.IPNet, r Route, same func(a, b Route) bool) error {
+	tree, prefix, err := t.tree(prefix)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	found := false
+	ones, _ := prefix.Mask.Size()
+	err = iptree.Update(tree, prefix, func(value interface{}, exists bool) (interface{}, bool) {
+		routes, _ := value.([]Route)
+		updated := make([]Route, 0, len(routes))
+		for _, old := range routes {
+			if same(old, r) {
+				found = true
+			} else {
+				updated = append(updated, old)
+			}
+		}
+		if len(updated) == 0 {
+			//The root (default route) can't be removed, so empty it instead
+			return nil, ones == 0
+		}
+		return updated, true
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return iptree.ErrNotFound
+	}
+	return nil
+}
+
+//Routes returns every route to exactly prefix, best first
+func (t *RouteTable) Routes(prefix net.IPNet) ([]Route, error) {
+	tree, prefix, err := t.tree(prefix)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	value, err := tree.Find(prefix, false)
+	if err != nil {
+		return nil, err
+	}
+	routes, _ := value.([]Route)
+	if len(routes) == 0 {
+		return nil, iptree.ErrNotFound
+	}
+	return routes, nil
+}
+
+//Best returns the selected routes out of routes, which should all be in one table: those with
+//the lowest administrative distance, then the lowest metric. More than one route is an ECMP
+//group, which only holds routes of the same type
+func Best(routes []Route) []Route {
+	if len(routes) == 0 {
+		return nil
+	}
+	best := routes[:1]
+	for _, r := range routes[1:] {
+		if better(r, best[0]) {
+			best = []Route{r}
+		} else if !better(best[0], r) && r.Type == best[0].Type {
+			best = append(best[:len(best):len(best)], r)
+		}
+	}
+	return best
+}
+
+//Lookup is LookupTable in TableMain
+func (t *RouteTable) Lookup(ip net.IP) (net.IPNet, []Route, error) {
+	return t.LookupTable(ip, TableMain)
+}
+
+//LookupTable returns the most specific prefix containing ip with routes in table, and its
+//selected routes. Prefixes with routes only in other tables are passed over.
+//If the selected routes are blackhole, unreachable or prohibit routes, they are returned
+//with ErrRejected. A throw route ends the lookup with ErrNoRoute, as the kernel would go
+//on to the next table.
+func (t *RouteTable) LookupTable(ip net.IP, table string) (net.IPNet, []Route, error) {
+	bits := 128
+	if ip.To4() != nil {
+		bits = 32
+	}
+	tree, host, err := t.tree(net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	if err != nil {
+		return net.IPNet{}, nil, err
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	bits = len(host.IP) * 8
+	for ones := bits; ones >= 0; {
+		mask := net.CIDRMask(ones, bits)
+		prefix, value, err := iptree.FindMatch(tree, net.IPNet{IP: host.IP.Mask(mask), Mask: mask}, true)
+		if err != nil {
+			return net.IPNet{}, nil, err
+		}
+		routes, _ := value.([]Route)
+		var inTable []Route
+		for _, r := range routes {
+			if r.inTable(table) {
+				inTable = append(inTable, r)
+			}
+		}
+		if len(inTable) > 0 {
+			best := Best(inTable)
+			switch best[0].Type {
+			case TypeThrow:
+				return net.IPNet{}, nil, ErrNoRoute
+			case TypeBlackhole, TypeUnreachable, TypeProhibit:
+				return prefix, best, ErrRejected
+			}
+			return prefix, best, nil
+		}
+		//Try the next shorter prefix
+		ones, _ = prefix.Mask.Size()
+		ones--
+	}
+	return net.IPNet{}, nil, ErrNoRoute
+}
+
+//Traverse calls f for every prefix with routes, IPv4 first, in the same order as iptree.Root.Traverse.
+//Distance is that of the underlying tree, which has an empty root if there is no default route
+func (t *RouteTable) Traverse(f func(prefix net.IPNet, routes []Route, distance int) error) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, tree := range []iptree.Root{t.v4, t.v6} {
+		if err := tree.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+			routes, _ := value.([]Route)
+			if len(routes) == 0 {
+				return nil
+			}
+			return f(ipnet, routes, distance)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package routing_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"iptree"
+	"iptree/routing"
+)
+
+func mustCIDR(t *testing.T, s string) net.IPNet {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *ipnet
+}
+
+func routeString(prefix net.IPNet, routes []routing.Route) string {
+	s := prefix.String()
+	for _, r := range routes {
+		s += fmt.Sprintf(" %v/%v/%v", r.NextHop, r.Interface, r.Protocol)
+	}
+	return s
+}
+
+func TestRouteTable(t *testing.T) {
+	table := routing.New()
+
+	//No routes yet (expect error)
+	if _, _, err := table.Lookup(net.ParseIP("10.0.0.1")); err != routing.ErrNoRoute {
+		t.Error(err)
+	}
+
+	for _, c := range []struct {
+		prefix string
+		route  routing.Route
+	}{
+		{"0.0.0.0/0", routing.Route{NextHop: net.ParseIP("192.0.2.1"), Interface: "eth0", AdminDistance: 1, Protocol: routing.ProtoStatic}},
+		{"0.0.0.0/0", routing.Route{NextHop: net.ParseIP("192.0.2.254"), Interface: "eth0", AdminDistance: 20, Protocol: routing.ProtoBGP}},
+		{"10.0.0.0/8", routing.Route{NextHop: net.ParseIP("192.0.2.10"), Interface: "eth0", Metric: 20, AdminDistance: 110, Protocol: routing.ProtoOSPF}},
+		{"10.0.0.0/8", routing.Route{NextHop: net.ParseIP("192.0.2.11"), Interface: "eth0", Metric: 20, AdminDistance: 110, Protocol: routing.ProtoOSPF}},
+		{"10.0.0.0/8", routing.Route{NextHop: net.ParseIP("192.0.2.12"), Interface: "eth0", Metric: 30, AdminDistance: 110, Protocol: routing.ProtoOSPF}},
+		{"10.1.0.0/16", routing.Route{Interface: "eth1", Protocol: routing.ProtoConnected}},
+		{"2001:db8::/32", routing.Route{NextHop: net.ParseIP("fe80::1"), Interface: "eth0", Metric: 1024, Protocol: routing.ProtoKernel}},
+	} {
+		if err := table.Add(mustCIDR(t, c.prefix), c.route); err != nil {
+			t.Errorf("%v: %v", c.prefix, err)
+		}
+	}
+
+	for ip, want := range map[string]string{
+		"8.8.8.8":      "0.0.0.0/0 192.0.2.1/eth0/static",
+		"10.2.3.4":     "10.0.0.0/8 192.0.2.10/eth0/ospf 192.0.2.11/eth0/ospf",
+		"10.1.2.3":     "10.1.0.0/16 <nil>/eth1/connected",
+		"2001:db8::99": "2001:db8::/32 fe80::1/eth0/kernel",
+	} {
+		prefix, routes, err := table.Lookup(net.ParseIP(ip))
+		if err != nil {
+			t.Errorf("%v: %v", ip, err)
+		} else if got := routeString(prefix, routes); got != want {
+			t.Errorf("%v: %v", ip, got)
+		}
+	}
+	if _, _, err := table.Lookup(net.ParseIP("2001:4860::1")); err != routing.ErrNoRoute {
+		t.Error(err)
+	}
+
+	//A better metric replaces the same route, breaking the ECMP group
+	err := table.Add(mustCIDR(t, "10.0.0.0/8"), routing.Route{NextHop: net.ParseIP("192.0.2.12"), Interface: "eth0", Metric: 10, AdminDistance: 110, Protocol: routing.ProtoOSPF})
+	if err != nil {
+		t.Error(err)
+	}
+	routes, err := table.Routes(mustCIDR(t, "10.0.0.0/8"))
+	if got := routeString(mustCIDR(t, "10.0.0.0/8"), routes); err != nil || got != "10.0.0.0/8 192.0.2.12/eth0/ospf 192.0.2.10/eth0/ospf 192.0.2.11/eth0/ospf" {
+		t.Errorf("Error: %v, v: %v", err, got)
+	}
+
+	//Deleting the static default falls back to BGP, deleting that leaves no default
+	if err := table.Delete(mustCIDR(t, "0.0.0.0/0"), routing.Route{NextHop: net.ParseIP("192.0.2.1"), Interface: "eth0", Protocol: routing.ProtoStatic}); err != nil {
+		t.Error(err)
+	}
+	if _, routes, err := table.Lookup(net.ParseIP("8.8.8.8")); err != nil || routes[0].Protocol != routing.ProtoBGP {
+		t.Errorf("Error: %v, v: %v", err, routes)
+	}
+	if err := table.Delete(mustCIDR(t, "0.0.0.0/0"), routing.Route{NextHop: net.ParseIP("192.0.2.254"), Interface: "eth0", Protocol: routing.ProtoBGP}); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := table.Lookup(net.ParseIP("8.8.8.8")); err != routing.ErrNoRoute {
+		t.Error(err)
+	}
+
+	//Deleting the only route removes the prefix
+	if err := table.Delete(mustCIDR(t, "10.1.0.0/16"), routing.Route{Interface: "eth1", Protocol: routing.ProtoConnected}); err != nil {
+		t.Error(err)
+	}
+	if prefix, _, err := table.Lookup(net.ParseIP("10.1.2.3")); err != nil || prefix.String() != "10.0.0.0/8" {
+		t.Errorf("Error: %v, v: %v", err, prefix)
+	}
+	if err := table.Delete(mustCIDR(t, "10.1.0.0/16"), routing.Route{Interface: "eth1"}); err != iptree.ErrNotFound {
+		t.Error(err)
+	}
+
+	//Traverse only gives prefixes with routes
+	got := ""
+	table.Traverse(func(prefix net.IPNet, routes []routing.Route, distance int) error {
+		got += fmt.Sprintf("%v:%v:%v ", prefix.String(), len(routes), distance)
+		return nil
+	})
+	if got != "10.0.0.0/8:3:1 2001:db8::/32:1:1 " {
+		t.Error(got)
+	}
+}
+
+func TestLookupTable(t *testing.T) {
+	table := routing.New()
+	for _, c := range []struct {
+		prefix string
+		route  routing.Route
+	}{
+		{"0.0.0.0/0", routing.Route{NextHop: net.ParseIP("192.0.2.1"), Interface: "eth0"}},
+		{"10.0.0.0/8", routing.Route{Interface: "lo", Type: "local", Table: routing.TableLocal}},
+		{"10.1.0.0/16", routing.Route{NextHop: net.ParseIP("192.0.2.2"), Interface: "eth0", Table: "vpn"}},
+		{"10.98.0.0/16", routing.Route{Type: routing.TypeThrow}},
+		{"10.99.0.0/16", routing.Route{Type: routing.TypeBlackhole}},
+		{"10.99.0.0/16", routing.Route{Type: routing.TypeUnreachable, Metric: 10}},
+	} {
+		if err := table.Add(mustCIDR(t, c.prefix), c.route); err != nil {
+			t.Errorf("%v: %v", c.prefix, err)
+		}
+	}
+
+	for _, c := range []struct {
+		ip    string
+		table string
+		want  string
+		err   error
+	}{
+		//Routes in other tables are passed over
+		{"10.1.2.3", routing.TableMain, "0.0.0.0/0 192.0.2.1/eth0/", nil},
+		{"10.1.2.3", routing.TableLocal, "10.0.0.0/8 <nil>/lo/", nil},
+		{"10.1.2.3", "vpn", "10.1.0.0/16 192.0.2.2/eth0/", nil},
+		{"8.8.8.8", "vpn", "", routing.ErrNoRoute},
+		//A throw route ends the lookup, rejecting routes drop traffic
+		{"10.98.0.1", routing.TableMain, "", routing.ErrNoRoute},
+		{"10.99.0.1", routing.TableMain, "10.99.0.0/16 <nil>//", routing.ErrRejected},
+	} {
+		prefix, routes, err := table.LookupTable(net.ParseIP(c.ip), c.table)
+		if err != c.err {
+			t.Errorf("%v %v: %v", c.ip, c.table, err)
+		} else if got := routeString(prefix, routes); c.want != "" && got != c.want {
+			t.Errorf("%v %v: %v", c.ip, c.table, got)
+		}
+	}
+	if _, routes, _ := table.Lookup(net.ParseIP("10.99.0.1")); len(routes) != 1 || routes[0].Type != routing.TypeBlackhole {
+		t.Errorf("v: %v", routes)
+	}
+
+	//Routes of different types are never an ECMP group
+	best := routing.Best([]routing.Route{{Type: routing.TypeBlackhole}, {Interface: "eth0"}})
+	if len(best) != 1 {
+		t.Errorf("v: %v", best)
+	}
+}
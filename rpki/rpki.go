@@ -0,0 +1,208 @@
+//Package rpki validates BGP route origins against Route Origin Authorizations (RFC 6811),
+//held in iptree Roots.
+package rpki
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"iptree"
+)
+
+//ErrInvalidMaxLength is returned for a ROA whose maxLength is shorter than its prefix or longer than an address
+var ErrInvalidMaxLength = errors.New("Invalid ROA maxLength")
+
+//ErrInvalidPrefix is returned for a prefix that is neither IPv4 nor IPv6, or one with host bits set in an export
+var ErrInvalidPrefix = errors.New("Invalid prefix")
+
+//State is the validation state of a route, as defined by RFC 6811
+type State int
+
+//Validation states
+const (
+	NotFound State = iota
+	Valid
+	Invalid
+)
+
+func (s State) String() string {
+	switch s {
+	case NotFound:
+		return "NotFound"
+	case Valid:
+		return "Valid"
+	case Invalid:
+		return "Invalid"
+	}
+	return "unknown"
+}
+
+//ROA is a validated ROA payload: origin ASN may announce Prefix, and more specifics up to MaxLength
+type ROA struct {
+	Prefix    net.IPNet
+	MaxLength int
+	ASN       uint32
+	//TA is the trust anchor the ROA was validated under
+	TA string
+}
+
+//Store holds ROAs by prefix. Every prefix holds a []ROA
+type Store struct {
+	v4 iptree.Root
+	v6 iptree.Root
+}
+
+//NewStore returns an empty Store
+func NewStore() *Store {
+	return &Store{
+		v4: iptree.NewDefaultRoot(net.IPv4len, nil),
+		v6: iptree.NewDefaultRoot(net.IPv6len, nil),
+	}
+}
+
+//tree returns the tree for prefix, with prefix normalised to its length and masked
+func (s *Store) tree(prefix net.IPNet) (iptree.Root, net.IPNet, error) {
+	switch _, bits := prefix.Mask.Size(); {
+	case bits == 0:
+		return nil, prefix, iptree.ErrNonCanonicalMask
+	case bits == 32 && prefix.IP.To4() != nil:
+		return s.v4, net.IPNet{IP: prefix.IP.To4().Mask(prefix.Mask), Mask: prefix.Mask}, nil
+	case bits == 128 && len(prefix.IP) == net.IPv6len:
+		return s.v6, net.IPNet{IP: prefix.IP.Mask(prefix.Mask), Mask: prefix.Mask}, nil
+	}
+	return nil, prefix, ErrInvalidPrefix
+}
+
+//Add adds roa to the Store. A ROA for the same prefix, ASN, maxLength and trust anchor is only kept once
+func (s *Store) Add(roa ROA) error {
+	tree, prefix, err := s.tree(roa.Prefix)
+	if err != nil {
+		return err
+	}
+	ones, bits := prefix.Mask.Size()
+	if roa.MaxLength == 0 {
+		roa.MaxLength = ones
+	}
+	if roa.MaxLength < ones || roa.MaxLength > bits {
+		return ErrInvalidMaxLength
+	}
+	roa.Prefix = prefix
+
+	return iptree.Update(tree, prefix, func(value interface{}, exists bool) (interface{}, bool) {
+		roas, _ := value.([]ROA)
+		for _, old := range roas {
+			if old.ASN == roa.ASN && old.MaxLength == roa.MaxLength && old.TA == roa.TA {
+				return roas, true
+			}
+		}
+		return append(roas[:len(roas):len(roas)], roa), true
+	})
+}
+
+//Covering returns every ROA whose prefix contains prefix (or is equal to it), most specific first
+func (s *Store) Covering(prefix net.IPNet) ([]ROA, error) {
+	tree, prefix, err := s.tree(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var covering []ROA
+	for {
+		match, value, err := iptree.FindMatch(tree, prefix, true)
+		if err != nil {
+			return nil, err
+		}
+		roas, _ := value.([]ROA)
+		covering = append(covering, roas...)
+
+		//Look again from just above the match, to find its closest ancestor
+		ones, bits := match.Mask.Size()
+		if ones == 0 {
+			return covering, nil
+		}
+		mask := net.CIDRMask(ones-1, bits)
+		prefix = net.IPNet{IP: match.IP.Mask(mask), Mask: mask}
+	}
+}
+
+//Validate returns the state of a route for prefix originated by originASN.
+//A route is Valid if a covering ROA has its origin and a maxLength no shorter than the prefix,
+//Invalid if there are covering ROAs but none match, and NotFound without covering ROAs.
+//Origin AS 0 (as in AS0 ROAs, or a route with no origin) never matches
+func (s *Store) Validate(prefix net.IPNet, originASN uint32) (State, error) {
+	covering, err := s.Covering(prefix)
+	if err != nil {
+		return NotFound, err
+	}
+	if len(covering) == 0 {
+		return NotFound, nil
+	}
+	ones, _ := prefix.Mask.Size()
+	for _, roa := range covering {
+		if originASN != 0 && roa.ASN == originASN && ones <= roa.MaxLength {
+			return Valid, nil
+		}
+	}
+	return Invalid, nil
+}
+
+//jsonROA is a ROA as exported by validators such as Routinator, rpki-client and OctoRPKI
+type jsonROA struct {
+	ASN       json.RawMessage `json:"asn"`
+	Prefix    string          `json:"prefix"`
+	MaxLength int             `json:"maxLength"`
+	TA        string          `json:"ta"`
+}
+
+//Load reads ROAs from a validator JSON export, of the form
+//{"roas": [{"asn": "AS13335", "prefix": "1.1.1.0/24", "maxLength": 24, "ta": "apnic"}]}.
+//ASNs may be given as strings, with or without "AS", or as numbers. Prefixes with host bits set
+//are rejected with ErrInvalidPrefix
+func Load(r io.Reader) (*Store, error) {
+	var export struct {
+		ROAs []jsonROA `json:"roas"`
+	}
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, err
+	}
+
+	s := NewStore()
+	for i, j := range export.ROAs {
+		asn, err := parseASN(j.ASN)
+		if err != nil {
+			return nil, fmt.Errorf("roa %v: %v", i, err)
+		}
+		ip, prefix, err := net.ParseCIDR(j.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("roa %v: %v", i, err)
+		}
+		//Validators only export canonical prefixes, so "1.1.1.1/24" is a broken export
+		if !ip.Equal(prefix.IP) {
+			return nil, fmt.Errorf("roa %v: %v", i, ErrInvalidPrefix)
+		}
+		if err := s.Add(ROA{Prefix: *prefix, MaxLength: j.MaxLength, ASN: asn, TA: j.TA}); err != nil {
+			return nil, fmt.Errorf("roa %v: %v", i, err)
+		}
+	}
+	return s, nil
+}
+
+//parseASN parses 13335, "13335" or "AS13335"
+func parseASN(raw json.RawMessage) (uint32, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		s = string(raw)
+	}
+	if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+		s = s[2:]
+	}
+	asn, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid asn %s", raw)
+	}
+	return uint32(asn), nil
+}
@@ -0,0 +1,90 @@
+package rpki_test
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"iptree/rpki"
+)
+
+func TestValidate(t *testing.T) {
+	f, err := os.Open("testdata/roas.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	store, err := rpki.Load(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		prefix string
+		asn    uint32
+		want   rpki.State
+	}{
+		{"1.1.1.0/24", 13335, rpki.Valid},
+		{"1.1.1.0/24", 64666, rpki.Invalid},
+		//More specific than maxLength
+		{"1.1.1.0/25", 13335, rpki.Invalid},
+		{"8.8.8.0/24", 15169, rpki.NotFound},
+		//Less specific than any ROA
+		{"198.51.0.0/16", 64501, rpki.NotFound},
+		{"198.51.100.0/22", 64501, rpki.Valid},
+		{"198.51.100.0/22", 64502, rpki.Valid},
+		{"198.51.100.0/23", 64502, rpki.Invalid},
+		{"198.51.102.0/24", 64501, rpki.Valid},
+		//Covered by the /24 and its ancestor /22
+		{"198.51.101.0/24", 64503, rpki.Valid},
+		{"198.51.101.0/24", 64501, rpki.Valid},
+		{"198.51.101.0/24", 64502, rpki.Invalid},
+		//AS0 never matches
+		{"203.0.113.0/24", 0, rpki.Invalid},
+		{"203.0.113.128/25", 64500, rpki.Invalid},
+		{"2001:db8:1::/48", 64510, rpki.Valid},
+		{"2001:db8:1::/49", 64510, rpki.Invalid},
+		{"2001:db9::/32", 64510, rpki.NotFound},
+	} {
+		_, prefix, _ := net.ParseCIDR(c.prefix)
+		got, err := store.Validate(*prefix, c.asn)
+		if err != nil || got != c.want {
+			t.Errorf("%v AS%v: %v, %v", c.prefix, c.asn, got, err)
+		}
+	}
+
+	_, prefix, _ := net.ParseCIDR("198.51.101.0/24")
+	covering, err := store.Covering(*prefix)
+	if err != nil || len(covering) != 3 || covering[0].ASN != 64503 || covering[1].TA != "arin" {
+		t.Errorf("Error: %v, v: %v", err, covering)
+	}
+
+	//The same ROA under two trust anchors is kept for each
+	store, err = rpki.Load(strings.NewReader(`{"roas": [
+		{"asn": 13335, "prefix": "1.1.1.0/24", "maxLength": 24, "ta": "apnic"},
+		{"asn": 13335, "prefix": "1.1.1.0/24", "maxLength": 24, "ta": "arin"},
+		{"asn": 13335, "prefix": "1.1.1.0/24", "maxLength": 24, "ta": "arin"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, prefix, _ = net.ParseCIDR("1.1.1.0/24")
+	covering, err = store.Covering(*prefix)
+	if err != nil || len(covering) != 2 || covering[0].TA != "apnic" || covering[1].TA != "arin" {
+		t.Errorf("Error: %v, v: %v", err, covering)
+	}
+
+	//Bad exports (expect errors)
+	for _, bad := range []string{
+		`{"roas": [{"asn": "ASX", "prefix": "1.1.1.0/24", "maxLength": 24}]}`,
+		`{"roas": [{"asn": 1, "prefix": "1.1.1.0/33", "maxLength": 24}]}`,
+		`{"roas": [{"asn": 1, "prefix": "1.1.1.0/24", "maxLength": 23}]}`,
+		`{"roas": [{"asn": 1, "prefix": "1.1.1.1/24", "maxLength": 24}]}`,
+		`{"roas": [{"asn": 1, "prefix": "2001:db8::1/32", "maxLength": 48}]}`,
+		`{"roas": [`,
+	} {
+		if _, err := rpki.Load(strings.NewReader(bad)); err == nil {
+			t.Errorf("%v: no error", bad)
+		}
+	}
+}
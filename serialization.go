@@ -1,6 +1,8 @@
 package iptree
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"io"
 	"net"
@@ -16,14 +18,39 @@ const (
 	smarkEnd
 )
 
-func serialize(root Root, out io.Writer, serializer ValueSerializer) error {
+//sflag - serialization flags
+//stored in the high bits of the IP length written at the start of the stream
+const (
+	sflagDeltaIP uint16 = 1 << 15
+)
+
+//gzipMagic is the first two bytes of a gzip stream. An uncompressed stream starts with
+//the high byte of its header, which holds only sflags over an IP length of at most 16,
+//so it can never be 0x1f. Any new sflag must keep it that way.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func serialize(root Root, out io.Writer, serializer ValueSerializer, opts SerializeOptions) error {
+	if opts.Gzip {
+		zw := gzip.NewWriter(out)
+		if err := serialize(root, zw, serializer, SerializeOptions{DeltaIP: opts.DeltaIP}); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+
 	//Get length, write as uint16
 	iplen := root.GetIPLength()
 
-	if err := binary.Write(out, binary.BigEndian, uint16(iplen)); err != nil {
+	header := uint16(iplen)
+	if opts.DeltaIP {
+		header |= sflagDeltaIP
+	}
+	if err := binary.Write(out, binary.BigEndian, header); err != nil {
 		return err
 	}
 	lastd := -1
+	//Ancestors of the current node, only used for DeltaIP
+	var ancestors []net.IPNet
 	if err := root.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
 		//For all serialization, double check IP and mask lens
 		if len(ipnet.IP) != iplen || len(ipnet.Mask) != iplen {
@@ -40,29 +67,35 @@ func serialize(root Root, out io.Writer, serializer ValueSerializer) error {
 		} else {
 			bsmark = smarkUpLevel
 		}
+		levels := lastd - distance
 		lastd = distance
 
 		//Write node type and IP+Mask
 		if err := binary.Write(out, binary.BigEndian, bsmark); err != nil {
 			return err
 		}
-		if err := binary.Write(out, binary.BigEndian, ipnet.IP); err != nil {
-			return err
-		}
-		if err := binary.Write(out, binary.BigEndian, ipnet.Mask); err != nil {
+		if opts.DeltaIP {
+			//The reader needs to know the parent before it can read the IP,
+			//so say how many levels up we went
+			if bsmark == smarkUpLevel {
+				if err := binary.Write(out, binary.BigEndian, byte(levels)); err != nil {
+					return err
+				}
+			}
+			var parent *net.IPNet
+			if distance > 0 {
+				parent = &ancestors[distance-1]
+			}
+			ancestors = append(ancestors[:distance], ipnet)
+			if err := writeDeltaNet(out, ipnet, parent); err != nil {
+				return err
+			}
+		} else if err := writeNet(out, ipnet); err != nil {
 			return err
 		}
 
 		//Value
-		vbuf, err := serializer(value)
-		if err != nil {
-			return err
-		}
-		vlen := uint16(len(vbuf))
-		if err := binary.Write(out, binary.BigEndian, vlen); err != nil {
-			return err
-		}
-		return binary.Write(out, binary.BigEndian, vbuf)
+		return writeValue(out, value, serializer)
 	}); err != nil {
 		return err
 	}
@@ -70,99 +103,247 @@ func serialize(root Root, out io.Writer, serializer ValueSerializer) error {
 	return binary.Write(out, binary.BigEndian, smarkEnd)
 }
 
+//writeNet writes the IP and mask of ipnet
+func writeNet(out io.Writer, ipnet net.IPNet) error {
+	if err := binary.Write(out, binary.BigEndian, ipnet.IP); err != nil {
+		return err
+	}
+	return binary.Write(out, binary.BigEndian, ipnet.Mask)
+}
+
+//readNet reads an IP and mask written by writeNet
+func readNet(in io.Reader, iplen int) (net.IPNet, error) {
+	ipbuf := make([]byte, iplen*2, iplen*2)
+	if _, err := io.ReadFull(in, ipbuf); err != nil {
+		return net.IPNet{}, err
+	}
+	return net.IPNet{
+		IP:   net.IP(ipbuf[:iplen:iplen]),
+		Mask: net.IPMask(ipbuf[iplen:]),
+	}, nil
+}
+
+//writeDeltaNet writes ipnet as its prefix length followed by only the IP bytes that
+//are not already given by the parent, with trailing zero bytes dropped.
+//parent is nil for the root.
+func writeDeltaNet(out io.Writer, ipnet net.IPNet, parent *net.IPNet) error {
+	ones, bits := ipnet.Mask.Size()
+	if bits == 0 {
+		return ErrNonCanonicalMask
+	}
+	skip := 0
+	if parent != nil {
+		pones, _ := parent.Mask.Size()
+		skip = pones / 8
+	}
+	rest := ipnet.IP[skip:]
+	for len(rest) > 0 && rest[len(rest)-1] == 0 {
+		rest = rest[:len(rest)-1]
+	}
+
+	if _, err := out.Write([]byte{byte(ones), byte(len(rest))}); err != nil {
+		return err
+	}
+	_, err := out.Write(rest)
+	return err
+}
+
+//readDeltaNet reads a prefix written by writeDeltaNet
+func readDeltaNet(in io.Reader, iplen int, parent *net.IPNet) (net.IPNet, error) {
+	var lens [2]byte
+	if _, err := io.ReadFull(in, lens[:]); err != nil {
+		return net.IPNet{}, err
+	}
+	ones, n := int(lens[0]), int(lens[1])
+
+	skip := 0
+	if parent != nil {
+		pones, _ := parent.Mask.Size()
+		if ones <= pones {
+			return net.IPNet{}, ErrInvalidData
+		}
+		skip = pones / 8
+	}
+	if ones > iplen*8 || n > iplen-skip {
+		return net.IPNet{}, ErrInvalidData
+	}
+
+	ip := make(net.IP, iplen)
+	if parent != nil {
+		copy(ip, parent.IP[:skip])
+	}
+	if _, err := io.ReadFull(in, ip[skip:skip+n]); err != nil {
+		return net.IPNet{}, err
+	}
+	return net.IPNet{
+		IP:   ip,
+		Mask: net.CIDRMask(ones, iplen*8),
+	}, nil
+}
+
+//writeValue serializes value and writes it, preceded by its length
+func writeValue(out io.Writer, value interface{}, serializer ValueSerializer) error {
+	vbuf, err := serializer(value)
+	if err != nil {
+		return err
+	}
+	if len(vbuf) > 0xffff {
+		return ErrValueTooLarge
+	}
+	vlen := uint16(len(vbuf))
+	if err := binary.Write(out, binary.BigEndian, vlen); err != nil {
+		return err
+	}
+	return binary.Write(out, binary.BigEndian, vbuf)
+}
+
+//readValue reads a value written by writeValue and deserializes it.
+//vbuf is reused if it is large enough, and the (possibly new) buffer is returned.
+func readValue(in io.Reader, vbuf []byte, deserializer ValueDeserializer) (interface{}, []byte, error) {
+	//Read value length
+	var vlen uint16
+	if err := binary.Read(in, binary.BigEndian, &vlen); err != nil {
+		return nil, vbuf, err
+	}
+
+	//Reset vbuf and read value bytes
+	if cap(vbuf) >= int(vlen) {
+		vbuf = vbuf[:vlen]
+	} else {
+		vbuf = make([]byte, vlen, vlen)
+	}
+	if _, err := io.ReadFull(in, vbuf); err != nil {
+		return nil, vbuf, err
+	}
+
+	value, err := deserializer(vbuf)
+	return value, vbuf, err
+}
+
 func deserialize(in io.Reader, deserializer ValueDeserializer) (Root, error) {
-	//Get IP Len
-	var iplen uint16
-	if err := binary.Read(in, binary.BigEndian, &iplen); err != nil {
+	var b treeBuilder
+	if err := decodeStream(in, deserializer, b.add); err != nil {
 		return nil, err
 	}
 
+	if b.root == nil {
+		return nil, nil
+	}
+	return b.root, nil
+}
+
+//decodeStream reads nodes written by serialize and passes each one to f as soon as it is read.
+//Distance is recovered by keeping a stack of the current node's ancestors, so memory use
+//grows with the depth of the tree rather than its size.
+//If f returns an error, decoding stops and the error is returned.
+func decodeStream(in io.Reader, deserializer ValueDeserializer, f Traverser) error {
+	//Check for compression without reading past the start of the stream
+	magic := make([]byte, len(gzipMagic))
+	if _, err := io.ReadFull(in, magic); err != nil {
+		return err
+	}
+	in = io.MultiReader(bytes.NewReader(magic), in)
+	if bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		in = zr
+	}
+
+	//Get IP Len and flags
+	var header uint16
+	if err := binary.Read(in, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	delta := header&sflagDeltaIP != 0
+	iplen := int(header &^ sflagDeltaIP)
+
 	var mark byte
-	var vlen uint16
-	var vbuf, ipbuf, maskbuf []byte
-	//recent := make([]*node, 0, 10)
-	//ri := 0
+	var vbuf []byte
+	//Ancestors of the most recently read node, root first
+	ancestors := make([]net.IPNet, 0, 10)
+	begun := false
 
 	if err := binary.Read(in, binary.BigEndian, &mark); err != nil {
-		return nil, err
+		return err
 	}
 
-	var root Root
-
 	for mark != smarkEnd {
-		//Read IP and mask
-		ipbuf = make([]byte, iplen*2, iplen*2)
-		maskbuf = ipbuf[iplen:]
-		ipbuf = ipbuf[:iplen]
-		if err := binary.Read(in, binary.BigEndian, ipbuf); err != nil {
-			return nil, err
-		}
-		if err := binary.Read(in, binary.BigEndian, maskbuf); err != nil {
-			return nil, err
+		//Only the first node may be (and must be) a root
+		switch mark {
+		case smarkBegin:
+			if begun {
+				return ErrInvalidData
+			}
+			begun = true
+		case smarkDownLevel, smarkSameLevel, smarkUpLevel:
+			if !begun {
+				return ErrInvalidData
+			}
+		default:
+			return ErrInvalidData
 		}
 
-		//Read value length
-		if err := binary.Read(in, binary.BigEndian, &vlen); err != nil {
-			return nil, err
-		}
+		var ipnet net.IPNet
+		var err error
+		if delta {
+			//Markers give the parent, which is needed to read the IP
+			pop := 0
+			switch mark {
+			case smarkSameLevel:
+				pop = 1
+			case smarkUpLevel:
+				var levels byte
+				if err := binary.Read(in, binary.BigEndian, &levels); err != nil {
+					return err
+				}
+				pop = int(levels) + 1
+			}
+			if pop >= len(ancestors) && mark != smarkBegin {
+				return ErrInvalidData
+			}
+			ancestors = ancestors[:len(ancestors)-pop]
 
-		//Reset vbuf and read value bytes
-		if cap(vbuf) >= int(vlen) {
-			vbuf = vbuf[:vlen]
+			var parent *net.IPNet
+			if len(ancestors) > 0 {
+				parent = &ancestors[len(ancestors)-1]
+			}
+			if ipnet, err = readDeltaNet(in, iplen, parent); err != nil {
+				return err
+			}
 		} else {
-			vbuf = make([]byte, vlen, vlen)
-		}
-		if err := binary.Read(in, binary.BigEndian, vbuf); err != nil {
-			return nil, err
+			if ipnet, err = readNet(in, iplen); err != nil {
+				return err
+			}
+
+			//Pop until the top of the stack is our parent
+			if mark != smarkBegin {
+				for len(ancestors) > 0 && !containsNet(ancestors[len(ancestors)-1], ipnet) {
+					ancestors = ancestors[:len(ancestors)-1]
+				}
+				if len(ancestors) == 0 { //Not contained by root
+					return ErrInvalidData
+				}
+			}
 		}
 
-		value, err := deserializer(vbuf)
-		if err != nil {
-			return nil, err
+		var value interface{}
+		if value, vbuf, err = readValue(in, vbuf, deserializer); err != nil {
+			return err
 		}
 
-		//Following does not work, not sure why, fallback to Root.Insert()
-		//TODO: Optimize deserialization to not rely on insert
-
-		//Determine parent for this node
-		// switch mark {
-		// case smarkBegin:
-		// 	recent = append(recent, newNode)
-		// 	ri = 0
-		// case smarkDownLevel:
-		// 	recent = append(recent, newNode)
-		// 	recent[ri].children = append(recent[ri].children, newNode)
-		// 	ri++
-		// case smarkSameLevel:
-		// 	recent[ri-1].children = append(recent[ri].children, newNode)
-		// 	recent[ri] = newNode
-		// case smarkUpLevel:
-		// 	//Ensure ri is at least 2 greater than 0
-		// 	if ri < 2 {
-		// 		return nil, ErrInvalidData
-		// 	}
-		// 	recent = recent[:ri]
-		// 	ri--
-		// 	recent[ri-1].children = append(recent[ri-1].children, newNode)
-		// 	recent[ri] = newNode
-
-		if mark == smarkBegin {
-			root = makeNode(net.IPNet{
-				IP:   net.IP(ipbuf),
-				Mask: net.IPMask(maskbuf),
-			}, value, nil)
-		} else {
-			root.Insert(net.IPNet{
-				IP:   net.IP(ipbuf),
-				Mask: net.IPMask(maskbuf),
-			}, value)
+		if err := f(ipnet, value, len(ancestors)); err != nil {
+			return err
 		}
+		ancestors = append(ancestors, ipnet)
 
 		//Read next mark
 		if err := binary.Read(in, binary.BigEndian, &mark); err != nil {
-			return nil, err
+			return err
 		}
 	} //for mark != smarkEnd
 
-	return root, nil
+	return nil
 }
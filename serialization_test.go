@@ -0,0 +1,245 @@
+package iptree_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"iptree"
+)
+
+//buildStreamTree builds a small tree with several levels, so that a
+//serialized stream contains every kind of marker
+func buildStreamTree(t *testing.T) iptree.Root {
+	tree := iptree.NewDefaultRoot(net.IPv4len, "default")
+	for _, s := range []string{
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.1.0/24",
+		"10.1.1.128/25",
+		"10.2.0.0/16",
+		"192.168.0.0/16",
+	} {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Insert(*ipnet, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tree
+}
+
+func traverseString(tree iptree.Root) (string, error) {
+	tstring := ""
+	err := tree.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+		tstring += fmt.Sprintf("%v%v: %v\n", strings.Repeat(" ", distance), ipnet.String(), value)
+		return nil
+	})
+	return tstring, err
+}
+
+func TestDecodeStream(t *testing.T) {
+	tree := buildStreamTree(t)
+
+	want, err := traverseString(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sbuf bytes.Buffer
+	err = iptree.Serialize(tree, &sbuf, func(v interface{}) ([]byte, error) {
+		return []byte(v.(string)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := sbuf.Bytes()
+
+	//Stream every node, expect the same output as Traverse
+	got := ""
+	err = iptree.DecodeStream(bytes.NewReader(data), func(b []byte) (interface{}, error) {
+		return string(b), nil
+	}, func(ipnet net.IPNet, value interface{}, distance int) error {
+		got += fmt.Sprintf("%v%v: %v\n", strings.Repeat(" ", distance), ipnet.String(), value)
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if got != want {
+		t.Error(got)
+	}
+
+	//Stop early, expect our own error back
+	errStop := errors.New("stop")
+	count := 0
+	err = iptree.DecodeStream(bytes.NewReader(data), func(b []byte) (interface{}, error) {
+		return string(b), nil
+	}, func(ipnet net.IPNet, value interface{}, distance int) error {
+		count++
+		if count == 3 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || count != 3 {
+		t.Errorf("Error: %v, count: %v", err, count)
+	}
+
+	//Corrupt the first marker (expect error)
+	bad := append([]byte(nil), data...)
+	bad[2] = 0xff
+	err = iptree.DecodeStream(bytes.NewReader(bad), func(b []byte) (interface{}, error) {
+		return string(b), nil
+	}, func(ipnet net.IPNet, value interface{}, distance int) error {
+		return nil
+	})
+	if err != iptree.ErrInvalidData {
+		t.Error(err)
+	}
+
+	//Deserialize should build the same tree
+	tree, err = iptree.Deserialize(bytes.NewReader(data), func(b []byte) (interface{}, error) {
+		return string(b), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = traverseString(tree)
+	if err != nil {
+		t.Error(err)
+	}
+	if got != want {
+		t.Error(got)
+	}
+}
+
+func TestSerializeWithOptions(t *testing.T) {
+	tree := buildStreamTree(t)
+
+	//Add an IPv4 host under a deep node, then go back up to the root
+	err := tree.Insert(net.IPNet{
+		IP:   []byte{10, 1, 1, 200},
+		Mask: []byte{255, 255, 255, 255},
+	}, "10.1.1.200/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := traverseString(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []iptree.SerializeOptions{
+		{},
+		{DeltaIP: true},
+		{Gzip: true},
+		{DeltaIP: true, Gzip: true},
+	} {
+		var sbuf bytes.Buffer
+		if err := iptree.SerializeWithOptions(tree, &sbuf, iptree.StringSerializer, opts); err != nil {
+			t.Errorf("%+v: %v", opts, err)
+			continue
+		}
+
+		//Trailing bytes must not be consumed
+		sbuf.WriteString("trailer")
+
+		got, err := iptree.Deserialize(&sbuf, iptree.StringDeserializer)
+		if err != nil {
+			t.Errorf("%+v: %v", opts, err)
+			continue
+		}
+		tstring, err := traverseString(got)
+		if err != nil {
+			t.Error(err)
+		}
+		if tstring != want {
+			t.Errorf("%+v: %v", opts, tstring)
+		}
+		if !opts.Gzip && sbuf.String() != "trailer" {
+			t.Errorf("%+v: left %q", opts, sbuf.String())
+		}
+	}
+
+	//Non-canonical mask with DeltaIP (expect error)
+	tree = iptree.NewRoot(net.IPNet{
+		IP:   []byte{10, 0, 0, 0},
+		Mask: []byte{255, 0, 255, 0},
+	}, "odd")
+	err = iptree.SerializeWithOptions(tree, &bytes.Buffer{}, iptree.StringSerializer, iptree.SerializeOptions{DeltaIP: true})
+	if err != iptree.ErrNonCanonicalMask {
+		t.Error(err)
+	}
+}
+
+var benchTree iptree.Root
+
+//buildBenchTree returns a tree of just over 1M prefixes:
+//16 /8s, each with 256 /16s, each with 256 /24s
+func buildBenchTree(b *testing.B) iptree.Root {
+	if benchTree != nil {
+		return benchTree
+	}
+	tree := iptree.NewDefaultRoot(net.IPv4len, 0)
+	mask8 := net.CIDRMask(8, 32)
+	mask16 := net.CIDRMask(16, 32)
+	mask24 := net.CIDRMask(24, 32)
+	for a := 0; a < 16; a++ {
+		if err := tree.Insert(net.IPNet{IP: []byte{byte(a + 1), 0, 0, 0}, Mask: mask8}, a); err != nil {
+			b.Fatal(err)
+		}
+		for c := 0; c < 256; c++ {
+			if err := tree.Insert(net.IPNet{IP: []byte{byte(a + 1), byte(c), 0, 0}, Mask: mask16}, c); err != nil {
+				b.Fatal(err)
+			}
+			for d := 0; d < 256; d++ {
+				if err := tree.Insert(net.IPNet{IP: []byte{byte(a + 1), byte(c), byte(d), 0}, Mask: mask24}, d); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+	benchTree = tree
+	return tree
+}
+
+//countingWriter discards everything written to it, counting the bytes
+type countingWriter int
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+func BenchmarkSerializeWithOptions(b *testing.B) {
+	tree := buildBenchTree(b)
+
+	for _, c := range []struct {
+		name string
+		opts iptree.SerializeOptions
+	}{
+		{"plain", iptree.SerializeOptions{}},
+		{"delta", iptree.SerializeOptions{DeltaIP: true}},
+		{"gzip", iptree.SerializeOptions{Gzip: true}},
+		{"delta+gzip", iptree.SerializeOptions{DeltaIP: true, Gzip: true}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			var size countingWriter
+			for i := 0; i < b.N; i++ {
+				size = 0
+				if err := iptree.SerializeWithOptions(tree, &size, iptree.IntSerializer, c.opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size), "bytes")
+			b.ReportMetric(float64(size)/float64(tree.Count()), "bytes/prefix")
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package iptree
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".iptree"
+)
+
+//SnapshotStore saves and loads serialized trees in a directory.
+//Each snapshot is written to a temporary file, synced, and renamed into place, so a crash
+//never leaves a partially written snapshot under a snapshot name. Every snapshot ends with
+//a SHA-256 checksum of its contents, and Load skips any snapshot that fails it.
+//A SnapshotStore is not safe for concurrent use.
+type SnapshotStore struct {
+	Dir          string
+	Generations  int //Number of snapshots to keep, at least 1
+	Serializer   ValueSerializer
+	Deserializer ValueDeserializer
+	Options      SerializeOptions
+}
+
+//NewSnapshotStore returns a SnapshotStore keeping the latest generations snapshots in dir
+func NewSnapshotStore(dir string, generations int, serializer ValueSerializer, deserializer ValueDeserializer) *SnapshotStore {
+	return &SnapshotStore{
+		Dir:          dir,
+		Generations:  generations,
+		Serializer:   serializer,
+		Deserializer: deserializer,
+	}
+}
+
+//Save writes root as a new snapshot, then removes snapshots beyond the number of generations kept
+func (s *SnapshotStore) Save(root Root) error {
+	seqs, err := s.snapshots()
+	if err != nil {
+		return err
+	}
+	next := uint64(1)
+	if len(seqs) > 0 {
+		next = seqs[len(seqs)-1] + 1
+	}
+
+	tmp, err := os.CreateTemp(s.Dir, snapshotPrefix+"*.tmp")
+	if err != nil {
+		return err
+	}
+	if err := s.write(tmp, root); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path(next)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := syncDir(s.Dir); err != nil {
+		return err
+	}
+
+	//Drop the oldest generations
+	seqs = append(seqs, next)
+	keep := s.Generations
+	if keep < 1 {
+		keep = 1
+	}
+	for len(seqs) > keep {
+		if err := os.Remove(s.path(seqs[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		seqs = seqs[1:]
+	}
+	return nil
+}
+
+//write serializes root to f, followed by its checksum, and syncs f
+func (s *SnapshotStore) write(f *os.File, root Root) error {
+	h := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(f, h))
+	if err := serialize(root, w, s.Serializer, s.Options); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := f.Write(h.Sum(nil)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+//Load returns the tree in the newest snapshot that passes its checksum and can be deserialized.
+//If there is none, it returns ErrNoSnapshot.
+func (s *SnapshotStore) Load() (Root, error) {
+	seqs, err := s.snapshots()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(seqs) - 1; i >= 0; i-- {
+		if root, err := s.load(s.path(seqs[i])); err == nil {
+			return root, nil
+		}
+	}
+	return nil, ErrNoSnapshot
+}
+
+//load reads and verifies the snapshot at path
+func (s *SnapshotStore) load(path string) (Root, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < sha256.Size {
+		return nil, ErrInvalidData
+	}
+	body, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if actual := sha256.Sum256(body); !bytes.Equal(actual[:], sum) {
+		return nil, ErrInvalidData
+	}
+
+	root, err := deserialize(bytes.NewReader(body), s.Deserializer)
+	if err == nil && root == nil {
+		err = ErrInvalidData
+	}
+	return root, err
+}
+
+//snapshots returns the sequence numbers of every snapshot in the directory, oldest first
+func (s *SnapshotStore) snapshots() ([]uint64, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (s *SnapshotStore) path(seq uint64) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("%s%020d%s", snapshotPrefix, seq, snapshotSuffix))
+}
+
+//syncDir syncs a directory so a rename within it is durable.
+//Windows cannot sync directories, and renames there need no extra step.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
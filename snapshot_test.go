@@ -0,0 +1,82 @@
+package iptree_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"iptree"
+)
+
+func TestSnapshotStore(t *testing.T) {
+	dir := t.TempDir()
+	store := iptree.NewSnapshotStore(dir, 2, iptree.StringSerializer, iptree.StringDeserializer)
+
+	//Nothing saved yet (expect error)
+	if _, err := store.Load(); err != iptree.ErrNoSnapshot {
+		t.Error(err)
+	}
+
+	//Save three generations, each with a different root value
+	tree := buildStreamTree(t)
+	for _, v := range []string{"first", "second", "third"} {
+		err := tree.Insert(net.IPNet{
+			IP:   []byte{0, 0, 0, 0},
+			Mask: []byte{0, 0, 0, 0},
+		}, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Save(tree); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//Only two generations are kept
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatal(files)
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := loaded.Find(net.IPNet{IP: []byte{8, 8, 8, 8}, Mask: []byte{255, 255, 255, 255}}, true); err != nil || v != "third" {
+		t.Errorf("Error: %v, v: %v", err, v)
+	}
+	want, _ := traverseString(tree)
+	if got, _ := traverseString(loaded); got != want {
+		t.Error(got)
+	}
+
+	//Corrupt the newest snapshot, expect to fall back to the previous one
+	data, err := os.ReadFile(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(files[1], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := loaded.Find(net.IPNet{IP: []byte{8, 8, 8, 8}, Mask: []byte{255, 255, 255, 255}}, true); err != nil || v != "second" {
+		t.Errorf("Error: %v, v: %v", err, v)
+	}
+
+	//Truncate the older one too (expect error)
+	if err := os.Truncate(files[0], 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); err != iptree.ErrNoSnapshot {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,396 @@
+package iptree
+
+import (
+	"container/heap"
+	"net"
+	"sync"
+	"time"
+)
+
+//Clock tells a TTLRoot the time. It can be replaced to control expiry in tests.
+type Clock interface {
+	//Now returns the current time
+	Now() time.Time
+
+	//After returns a channel that receives the time once d has passed, as time.After
+	After(d time.Duration) <-chan time.Time
+}
+
+//systemClock is the Clock used by default
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+//ExpiryFunc is called with every element that expires
+type ExpiryFunc func(ipnet net.IPNet, value interface{})
+
+//TTLRoot is a Root whose elements can be inserted with a time-to-live.
+//Expired elements are removed when a Find reaches them, when Expire is called, or by a
+//janitor started with StartJanitor. Expired elements are removed as by Update, so
+//their children are kept. Elements inserted without a TTL never expire, and Insert
+//clears any TTL the element had. Update only changes the value, so the TTL is kept.
+//
+//A TTLRoot is safe for concurrent use. The functions passed to Traverse, Update and
+//RemoveIf are called with the TTLRoot locked, so they must not use it.
+//ExpiryFuncs are called with it unlocked.
+//
+//Insertions that create a new root return ErrNewRoot containing the same TTLRoot, which
+//now uses the new root. When the root is removed, the new roots in ErrRemovedRoot are
+//TTLRoots sharing the clock and ExpiryFunc, each keeping the TTLs of its own elements.
+//A new root cannot expire, so its own TTL is dropped. The original TTLRoot is left empty
+//of TTLs, and changing it returns ErrStaleRoot.
+type TTLRoot struct {
+	mu        sync.RWMutex
+	root      Root
+	clock     Clock
+	onExpire  ExpiryFunc
+	deadlines map[string]*expiry
+	queue     expiryQueue
+	//stale is set once the root element has been removed
+	stale bool
+}
+
+//expiry is an element with a TTL
+type expiry struct {
+	ipnet    net.IPNet
+	deadline time.Time
+	index    int //Position in expiryQueue
+}
+
+//expiryQueue is a min-heap of expiries, soonest first
+type expiryQueue []*expiry
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].deadline.Before(q[j].deadline) }
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *expiryQueue) Push(x interface{}) {
+	e := x.(*expiry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return e
+}
+
+//expired is an element removed by expiry, waiting for its ExpiryFunc call
+type expired struct {
+	ipnet net.IPNet
+	value interface{}
+}
+
+//WithTTL returns a TTLRoot that applies every operation to root.
+//If clock is nil, the system clock is used. onExpire may be nil.
+func WithTTL(root Root, clock Clock, onExpire ExpiryFunc) *TTLRoot {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &TTLRoot{
+		root:      root,
+		clock:     clock,
+		onExpire:  onExpire,
+		deadlines: make(map[string]*expiry),
+	}
+}
+
+//InsertWithTTL inserts or overwrites an element which expires after ttl.
+//The root cannot expire, so if IPNet is the root or would become the new root, returns ErrRootTTL
+func (t *TTLRoot) InsertWithTTL(ipnet net.IPNet, value interface{}, ttl time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stale {
+		return ErrStaleRoot
+	}
+
+	root := t.root
+	if base := baseNode(root); base != nil && sameIPLen(base.IPNet, ipnet) && onPath(ipnet, base.IPNet) {
+		return ErrRootTTL
+	}
+
+	if err := root.Insert(ipnet, value); err != nil {
+		return err
+	}
+	k := netKey(ipnet)
+	deadline := t.clock.Now().Add(ttl)
+	if e, ok := t.deadlines[k]; ok {
+		e.deadline = deadline
+		heap.Fix(&t.queue, e.index)
+		return nil
+	}
+	e := &expiry{ipnet: ipnet, deadline: deadline}
+	t.deadlines[k] = e
+	heap.Push(&t.queue, e)
+	return nil
+}
+
+//Expire removes every element whose TTL has passed, calls the ExpiryFunc for each,
+//and returns how many were removed
+func (t *TTLRoot) Expire() int {
+	t.mu.Lock()
+	gone := t.expireLocked(t.clock.Now())
+	t.mu.Unlock()
+
+	t.notify(gone)
+	return len(gone)
+}
+
+//StartJanitor starts a goroutine calling Expire every interval, until stop is called.
+//The interval is measured with the Clock's After.
+func (t *TTLRoot) StartJanitor(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-t.clock.After(interval):
+				t.Expire()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+		})
+	}
+}
+
+//expireLocked removes every element due by now. t.mu must be held.
+func (t *TTLRoot) expireLocked(now time.Time) []expired {
+	var gone []expired
+	for len(t.queue) > 0 && !now.Before(t.queue[0].deadline) {
+		e := heap.Pop(&t.queue).(*expiry)
+		delete(t.deadlines, netKey(e.ipnet))
+
+		var value interface{}
+		found := false
+		err := Update(t.root, e.ipnet, func(v interface{}, exists bool) (interface{}, bool) {
+			value, found = v, exists
+			return nil, false
+		})
+		if err == nil && found {
+			gone = append(gone, expired{e.ipnet, value})
+		}
+	}
+	return gone
+}
+
+//notify calls the ExpiryFunc for every expired element
+func (t *TTLRoot) notify(gone []expired) {
+	if t.onExpire == nil {
+		return
+	}
+	for _, e := range gone {
+		t.onExpire(e.ipnet, e.value)
+	}
+}
+
+//clearTTL forgets the TTL of ipnet, if it has one. t.mu must be held.
+func (t *TTLRoot) clearTTL(ipnet net.IPNet) {
+	k := netKey(ipnet)
+	if e, ok := t.deadlines[k]; ok {
+		heap.Remove(&t.queue, e.index)
+		delete(t.deadlines, k)
+	}
+}
+
+//forget forgets the TTL of every element removed by events. t.mu must be held.
+func (t *TTLRoot) forget(events []Event) {
+	for _, e := range events {
+		if e.Type == EventRemoved {
+			t.clearTTL(e.IPNet)
+		}
+	}
+}
+
+//followRoot switches to any new root in err, or hands the TTLs to the new roots when
+//the root element was removed. t.mu must be held.
+func (t *TTLRoot) followRoot(err error) error {
+	switch e := err.(type) {
+	case ErrNewRoot:
+		t.root = e.NewRoot
+		return ErrNewRoot{t}
+	case ErrRemovedRoot:
+		roots := make([]*TTLRoot, len(e.NewRoots))
+		tops := make([]net.IPNet, len(e.NewRoots))
+		for i, r := range e.NewRoots {
+			roots[i] = WithTTL(r, t.clock, t.onExpire)
+			tops[i] = topIPNet(r)
+			e.NewRoots[i] = roots[i]
+		}
+		for k, ex := range t.deadlines {
+			for i, top := range tops {
+				if !sameIPLen(top, ex.ipnet) || !onPath(top, ex.ipnet) {
+					continue
+				}
+				if compareMask(top.Mask, ex.ipnet.Mask) != 0 {
+					roots[i].deadlines[k] = ex
+					heap.Push(&roots[i].queue, ex)
+				}
+				break
+			}
+		}
+		t.deadlines = make(map[string]*expiry)
+		t.queue = nil
+		t.stale = true
+		return e
+	}
+	return err
+}
+
+//Find an element at IPNet, first removing any expired element it would return
+func (t *TTLRoot) Find(ipnet net.IPNet, allowSupernet bool) (interface{}, error) {
+	_, value, err := t.FindMatch(ipnet, allowSupernet)
+	return value, err
+}
+
+//FindMatch is the same as Find, but also returns the IPNet of the element found
+func (t *TTLRoot) FindMatch(ipnet net.IPNet, allowSupernet bool) (net.IPNet, interface{}, error) {
+	//Most finds reach an element that has not expired, so look first with a read lock
+	now := t.clock.Now()
+	t.mu.RLock()
+	match, value, err := findMatch(t.root, ipnet, allowSupernet)
+	due := false
+	if err == nil {
+		e, ok := t.deadlines[netKey(match)]
+		due = ok && !now.Before(e.deadline)
+	}
+	t.mu.RUnlock()
+	if !due {
+		return match, value, err
+	}
+
+	t.mu.Lock()
+	var gone []expired
+	defer func() {
+		t.mu.Unlock()
+		t.notify(gone)
+	}()
+
+	for {
+		match, value, err := findMatch(t.root, ipnet, allowSupernet)
+		if err != nil {
+			return net.IPNet{}, nil, err
+		}
+		e, ok := t.deadlines[netKey(match)]
+		if !ok || now.Before(e.deadline) {
+			return match, value, nil
+		}
+
+		//Expired, so remove it and look again
+		t.clearTTL(e.ipnet)
+		if err := Update(t.root, e.ipnet, func(interface{}, bool) (interface{}, bool) {
+			return nil, false
+		}); err != nil {
+			return net.IPNet{}, nil, err
+		}
+		gone = append(gone, expired{match, value})
+	}
+}
+
+func (t *TTLRoot) Insert(ipnet net.IPNet, value interface{}) error {
+	return t.mutate(insertion(ipnet, value), nil)
+}
+
+func (t *TTLRoot) Update(ipnet net.IPNet, f Updater) error {
+	return t.mutate(mutation{op: mopUpdate, ipnet: ipnet, updater: f}, nil)
+}
+
+func (t *TTLRoot) Remove(ipnet net.IPNet) error {
+	return t.mutate(mutation{op: mopRemove, ipnet: ipnet}, nil)
+}
+
+func (t *TTLRoot) RemoveSubtree(ipnet net.IPNet) error {
+	return t.mutate(mutation{op: mopRemoveSubtree, ipnet: ipnet}, nil)
+}
+
+func (t *TTLRoot) RemoveIf(pred Predicate) error {
+	return t.mutate(mutation{op: mopRemoveIf, pred: pred}, nil)
+}
+
+func (t *TTLRoot) Prune(maxDepth int) error {
+	return t.mutate(mutation{op: mopPrune, maxDepth: maxDepth}, nil)
+}
+
+//mutate applies m with the TTLRoot locked, and forgets the TTL of every element it
+//removes, and of any element it inserts
+func (t *TTLRoot) mutate(m mutation, c *changeLog) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stale {
+		return ErrStaleRoot
+	}
+
+	var changes changeLog
+	err := mutate(t.root, m, &changes)
+	if !succeeded(err) {
+		return err
+	}
+	t.forget(changes.events)
+	if m.insert {
+		t.clearTTL(m.ipnet)
+	}
+	if c != nil {
+		c.events = append(c.events, changes.events...)
+	}
+	return t.followRoot(err)
+}
+
+func (t *TTLRoot) Traverse(f Traverser) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.root.Traverse(f)
+}
+
+func (t *TTLRoot) GetIPLength() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.root.GetIPLength()
+}
+
+func (t *TTLRoot) Count() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.root.Count()
+}
+
+func (t *TTLRoot) unwrap() Root {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.root
+}
+
+//rewrap returns a TTLRoot for a committed transaction, with a copy of every TTL that
+//still applies. Inserted elements lose their TTL, as with Insert.
+func (t *TTLRoot) rewrap(root Root, ops []txOp, events []Event) (Root, error) {
+	nt := WithTTL(root, t.clock, t.onExpire)
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.stale {
+		return nil, ErrStaleRoot
+	}
+	for k, e := range t.deadlines {
+		ce := &expiry{ipnet: e.ipnet, deadline: e.deadline}
+		nt.deadlines[k] = ce
+		heap.Push(&nt.queue, ce)
+	}
+	for _, op := range ops {
+		nt.clearTTL(op.ipnet)
+	}
+	nt.forget(events)
+	return nt, nil
+}
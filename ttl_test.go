@@ -0,0 +1,194 @@
+package iptree_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"iptree"
+)
+
+//fakeClock is a Clock that only moves when Advance is called
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	waiting chan struct{} //Receives when After is called
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), waiting: make(chan struct{}, 1)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	c := make(chan time.Time, 1)
+	f.timers = append(f.timers, fakeTimer{f.now.Add(d), c})
+	f.mu.Unlock()
+	select {
+	case f.waiting <- struct{}{}:
+	default:
+	}
+	return c
+}
+
+//Advance moves the clock on by d, firing every timer that is due
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	timers := f.timers[:0]
+	for _, t := range f.timers {
+		if f.now.Before(t.at) {
+			timers = append(timers, t)
+			continue
+		}
+		t.c <- f.now
+	}
+	f.timers = timers
+}
+
+func TestTTL(t *testing.T) {
+	clock := newFakeClock()
+
+	var expired []string
+	tree := iptree.WithTTL(buildStreamTree(t), clock, func(ipnet net.IPNet, value interface{}) {
+		expired = append(expired, ipnet.String())
+	})
+
+	//Ban 203.0.113.0/24 for 15 minutes and 198.51.100.0/24 for an hour
+	_, ban1, _ := net.ParseCIDR("203.0.113.0/24")
+	if err := tree.InsertWithTTL(*ban1, "banned", 15*time.Minute); err != nil {
+		t.Error(err)
+	}
+	_, ban2, _ := net.ParseCIDR("198.51.100.0/24")
+	if err := tree.InsertWithTTL(*ban2, "banned", time.Hour); err != nil {
+		t.Error(err)
+	}
+
+	//Root cannot expire (expect error)
+	_, root, _ := net.ParseCIDR("0.0.0.0/0")
+	if err := tree.InsertWithTTL(*root, "x", time.Minute); err != iptree.ErrRootTTL {
+		t.Error(err)
+	}
+
+	host := net.IPNet{IP: []byte{203, 0, 113, 7}, Mask: []byte{255, 255, 255, 255}}
+	if v, err := tree.Find(host, true); err != nil || v != "banned" {
+		t.Errorf("Error: %v, v: %v", err, v)
+	}
+
+	//After 20 minutes, Find removes the first ban and falls back to the root
+	clock.Advance(20 * time.Minute)
+	if v, err := tree.Find(host, true); err != nil || v != "default" {
+		t.Errorf("Error: %v, v: %v", err, v)
+	}
+	if len(expired) != 1 || expired[0] != "203.0.113.0/24" {
+		t.Error(expired)
+	}
+
+	//Overwriting without a TTL keeps the second ban forever
+	if err := tree.Insert(*ban2, "permanent"); err != nil {
+		t.Error(err)
+	}
+	clock.Advance(2 * time.Hour)
+	if n := tree.Expire(); n != 0 {
+		t.Errorf("Expired %v", n)
+	}
+
+	//Expire removes a due element without a Find
+	if err := tree.InsertWithTTL(*ban1, "banned", time.Minute); err != nil {
+		t.Error(err)
+	}
+	c := tree.Count()
+	clock.Advance(time.Minute)
+	if n := tree.Expire(); n != 1 || tree.Count() != c-1 {
+		t.Errorf("Expired %v, count %v", n, tree.Count())
+	}
+
+	//Update changes the value but keeps the TTL
+	if err := tree.InsertWithTTL(*ban1, "banned", time.Minute); err != nil {
+		t.Error(err)
+	}
+	if err := iptree.Update(tree, *ban1, func(interface{}, bool) (interface{}, bool) {
+		return "still banned", true
+	}); err != nil {
+		t.Error(err)
+	}
+	clock.Advance(time.Minute)
+	if n := tree.Expire(); n != 1 {
+		t.Errorf("Expired %v", n)
+	}
+}
+
+func TestTTLJanitor(t *testing.T) {
+	clock := newFakeClock()
+	expired := make(chan string, 1)
+	tree := iptree.WithTTL(buildStreamTree(t), clock, func(ipnet net.IPNet, value interface{}) {
+		expired <- ipnet.String()
+	})
+	_, ban, _ := net.ParseCIDR("203.0.113.0/24")
+	if err := tree.InsertWithTTL(*ban, "banned", time.Minute); err != nil {
+		t.Error(err)
+	}
+
+	//Wait for the janitor to start waiting on the clock, then move it on
+	stop := tree.StartJanitor(time.Minute)
+	defer stop()
+	<-clock.waiting
+	clock.Advance(time.Minute)
+	if e := <-expired; e != "203.0.113.0/24" {
+		t.Error(e)
+	}
+	if _, err := tree.Find(*ban, false); err != iptree.ErrNotFound {
+		t.Error(err)
+	}
+}
+
+func TestTTLRemoveRoot(t *testing.T) {
+	clock := newFakeClock()
+	tree := iptree.WithTTL(iptree.NewDefaultRoot(4, "default"), clock, nil)
+	_, ten, _ := net.ParseCIDR("10.0.0.0/8")
+	_, tenOne, _ := net.ParseCIDR("10.1.0.0/16")
+	if err := tree.InsertWithTTL(*ten, "ten", time.Minute); err != nil {
+		t.Error(err)
+	}
+	if err := tree.InsertWithTTL(*tenOne, "ten one", time.Minute); err != nil {
+		t.Error(err)
+	}
+
+	//The new root keeps the TTLs beneath it, but not its own
+	_, root, _ := net.ParseCIDR("0.0.0.0/0")
+	err := tree.Remove(*root)
+	rr, ok := err.(iptree.ErrRemovedRoot)
+	if !ok || len(rr.NewRoots) != 1 {
+		t.Fatal(err)
+	}
+	newTree, ok := rr.NewRoots[0].(*iptree.TTLRoot)
+	if !ok {
+		t.Fatalf("%T", rr.NewRoots[0])
+	}
+	clock.Advance(time.Minute)
+	if n := newTree.Expire(); n != 1 || newTree.Count() != 1 {
+		t.Errorf("Expired %v, count %v", n, newTree.Count())
+	}
+
+	//The old TTLRoot cannot be changed
+	if err := tree.Insert(*tenOne, "x"); err != iptree.ErrStaleRoot {
+		t.Error(err)
+	}
+	if n := tree.Expire(); n != 0 {
+		t.Errorf("Expired %v", n)
+	}
+}
@@ -0,0 +1,165 @@
+package iptree
+
+import "net"
+
+//wrapper is implemented by Roots that add behaviour to another Root, such as the one
+//returned by Attach, so that operations working on the underlying tree can preserve it
+type wrapper interface {
+	Root
+
+	//unwrap returns the wrapped Root
+	unwrap() Root
+
+	//rewrap returns a wrapper like this one around root, which is a copy of the
+	//wrapped tree with ops already applied, causing events
+	rewrap(root Root, ops []txOp, events []Event) (Root, error)
+}
+
+//retirer is implemented by wrappers that share state, such as a log or subscribers, with
+//the wrapper rewrap returns. Once every rewrap succeeds, retire hands that state over.
+type retirer interface {
+	retire(events []Event)
+}
+
+//txOp is a single staged or logged operation.
+//op is one of the wop constants; for wopPrune, value holds the depth.
+type txOp struct {
+	op    byte
+	ipnet net.IPNet
+	value interface{}
+}
+
+//Tx stages Insert and Remove operations so they can be applied all at once.
+//Staged operations are only checked for IP length; everything else is checked by Commit.
+//A Tx is not safe for concurrent use.
+type Tx struct {
+	root Root
+	ops  []txOp
+	done bool
+}
+
+//Begin returns a transaction on root
+func Begin(root Root) *Tx {
+	return &Tx{root: root}
+}
+
+//Insert stages an insertion
+func (tx *Tx) Insert(ipnet net.IPNet, value interface{}) error {
+	return tx.stage(txOp{wopInsert, ipnet, value})
+}
+
+//Remove stages a removal
+func (tx *Tx) Remove(ipnet net.IPNet) error {
+	return tx.stage(txOp{wopRemove, ipnet, nil})
+}
+
+func (tx *Tx) stage(op txOp) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if len(op.ipnet.IP) != tx.root.GetIPLength() || len(op.ipnet.Mask) != len(op.ipnet.IP) {
+		return ErrWrongIPLength
+	}
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+//Commit applies every staged operation, in order, to a copy of the tree and returns the copy.
+//Copying takes time and memory in proportion to the size of the whole tree.
+//The original tree is never modified, so readers using it never see a partial update;
+//publish the returned root to make the update visible. Wrappers that share state with
+//the returned root, such as those from Attach and Watch, are retired: the original root
+//can still be read, but changing it returns ErrStaleRoot.
+//If any operation fails, including removing the root, nothing is applied and ErrTxFailed
+//is returned along with the original root. Insertions that create a new root are allowed,
+//and the returned root is the final one.
+func (tx *Tx) Commit() (Root, error) {
+	if tx.done {
+		return tx.root, ErrTxDone
+	}
+	tx.done = true
+
+	var root Root
+	base, err := copyTree(tx.root)
+	if err != nil {
+		return tx.root, err
+	}
+	root = base
+
+	var changes changeLog
+	for i, op := range tx.ops {
+		if op.op == wopRemove {
+			err = mutate(root, mutation{op: mopRemove, ipnet: op.ipnet}, &changes)
+		} else {
+			err = mutate(root, insertion(op.ipnet, op.value), &changes)
+			if nr, ok := err.(ErrNewRoot); ok {
+				root, err = nr.NewRoot, nil
+			}
+		}
+		if err != nil {
+			return tx.root, ErrTxFailed{i, err}
+		}
+	}
+
+	if root, err = rewrapTx(tx.root, root, tx.ops, changes.events); err != nil {
+		return tx.root, err
+	}
+	for r := tx.root; r != nil; {
+		if rt, ok := r.(retirer); ok {
+			rt.retire(changes.events)
+		}
+		w, ok := r.(wrapper)
+		if !ok {
+			break
+		}
+		r = w.unwrap()
+	}
+	return root, nil
+}
+
+//Rollback discards every staged operation
+func (tx *Tx) Rollback() {
+	tx.ops = nil
+	tx.done = true
+}
+
+//rewrapTx wraps root in the same wrappers as orig, innermost first
+func rewrapTx(orig Root, root Root, ops []txOp, events []Event) (Root, error) {
+	w, ok := orig.(wrapper)
+	if !ok {
+		return root, nil
+	}
+	inner, err := rewrapTx(w.unwrap(), root, ops, events)
+	if err != nil {
+		return nil, err
+	}
+	return w.rewrap(inner, ops, events)
+}
+
+//baseNode returns the tree underneath any wrappers around root, or nil if root
+//is not built on this package's tree
+func baseNode(root Root) *node {
+	for {
+		switch r := root.(type) {
+		case *node:
+			return r
+		case wrapper:
+			root = r.unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+//topIPNet returns the IPNet of the first element root traverses, which is its root element
+func topIPNet(root Root) net.IPNet {
+	if base := baseNode(root); base != nil {
+		return base.IPNet
+	}
+	var top net.IPNet
+	root.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+		top = ipnet
+		return ErrNotFound //Stop after the first element
+	})
+	return top
+}
@@ -0,0 +1,164 @@
+package iptree_test
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"iptree"
+)
+
+func TestTx(t *testing.T) {
+	tree := buildStreamTree(t)
+	before, err := traverseString(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Stage with bad IP Length (expect error)
+	tx := iptree.Begin(tree)
+	err = tx.Insert(net.IPNet{
+		IP:   []byte{1, 2, 3, 4, 5},
+		Mask: []byte{255, 255, 255, 255, 255},
+	}, "blah")
+	if err != iptree.ErrWrongIPLength {
+		t.Error(err)
+	}
+
+	//Remove of a missing prefix fails the whole commit
+	_, ipnet, _ := net.ParseCIDR("172.16.0.0/12")
+	if err := tx.Insert(*ipnet, "172.16.0.0/12"); err != nil {
+		t.Error(err)
+	}
+	_, ipnet, _ = net.ParseCIDR("10.9.0.0/16")
+	if err := tx.Remove(*ipnet); err != nil {
+		t.Error(err)
+	}
+	got, err := tx.Commit()
+	if err != (iptree.ErrTxFailed{Op: 1, Err: iptree.ErrNotFound}) || got != tree {
+		t.Errorf("Error: %v, root: %v", err, got)
+	}
+	if after, _ := traverseString(tree); after != before {
+		t.Error(after)
+	}
+
+	//Committed transactions cannot be used again
+	if err := tx.Remove(*ipnet); err != iptree.ErrTxDone {
+		t.Error(err)
+	}
+
+	//Successful commit leaves the original untouched
+	var logbuf bytes.Buffer
+	tree = iptree.Attach(iptree.NewRoot(net.IPNet{
+		IP:   []byte{10, 0, 0, 0},
+		Mask: []byte{255, 0, 0, 0},
+	}, "ten"), iptree.NewMutationLog(&logbuf, iptree.StringSerializer))
+	before, _ = traverseString(tree)
+
+	tx = iptree.Begin(tree)
+	_, ipnet, _ = net.ParseCIDR("10.1.0.0/16")
+	tx.Insert(*ipnet, "10.1.0.0/16")
+	_, ipnet, _ = net.ParseCIDR("0.0.0.0/0")
+	tx.Insert(*ipnet, "default")
+	_, ipnet, _ = net.ParseCIDR("192.168.0.0/16")
+	tx.Insert(*ipnet, "192.168.0.0/16")
+	got, err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := traverseString(tree); after != before {
+		t.Error(after)
+	}
+	//The original root is no longer attached to the log
+	if err := tree.Insert(*ipnet, "stale"); err != iptree.ErrStaleRoot {
+		t.Error(err)
+	}
+	want := "0.0.0.0/0: default\n 10.0.0.0/8: ten\n  10.1.0.0/16: 10.1.0.0/16\n 192.168.0.0/16: 192.168.0.0/16\n"
+	if s, _ := traverseString(got); s != want {
+		t.Error(s)
+	}
+
+	//The committed root is still logged, and the log replays to the same tree
+	_, ipnet, _ = net.ParseCIDR("10.2.0.0/16")
+	if err := got.Insert(*ipnet, "10.2.0.0/16"); err != nil {
+		t.Error(err)
+	}
+	var snapshot bytes.Buffer
+	iptree.Serialize(iptree.NewRoot(net.IPNet{
+		IP:   []byte{10, 0, 0, 0},
+		Mask: []byte{255, 0, 0, 0},
+	}, "ten"), &snapshot, iptree.StringSerializer)
+	replayed, err := iptree.Replay(&snapshot, &logbuf, iptree.StringDeserializer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, _ := traverseString(got)
+	s2, _ := traverseString(replayed)
+	if s1 != s2 {
+		t.Error(s2)
+	}
+
+	//Removing the root fails the commit
+	tx = iptree.Begin(got)
+	_, ipnet, _ = net.ParseCIDR("0.0.0.0/0")
+	tx.Remove(*ipnet)
+	_, err = tx.Commit()
+	if reflect.TypeOf(err) != reflect.TypeOf(iptree.ErrTxFailed{}) {
+		t.Error(err)
+	}
+}
+
+func TestTxLogBatch(t *testing.T) {
+	tree := buildStreamTree(t)
+	var snapshot, logbuf bytes.Buffer
+	if err := iptree.Serialize(tree, &snapshot, iptree.StringSerializer); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := traverseString(tree)
+	tree = iptree.Attach(tree, iptree.NewMutationLog(&logbuf, iptree.StringSerializer))
+
+	tx := iptree.Begin(tree)
+	for _, s := range []string{"172.16.0.0/12", "10.3.0.0/16"} {
+		_, ipnet, _ := net.ParseCIDR(s)
+		tx.Insert(*ipnet, s)
+	}
+	committed, err := tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := func(log []byte) (string, error) {
+		replayed, err := iptree.Replay(bytes.NewReader(snapshot.Bytes()), bytes.NewReader(log), iptree.StringDeserializer)
+		if err != nil {
+			return "", err
+		}
+		return traverseString(replayed)
+	}
+
+	//The whole batch replays to the committed tree
+	if got, err := replay(logbuf.Bytes()); err != nil {
+		t.Error(err)
+	} else if s, _ := traverseString(committed); got != s {
+		t.Error(got)
+	}
+
+	//A crash part way through the batch loses the whole transaction
+	for _, n := range []int{1, 9, 20, logbuf.Len() - 1} {
+		if got, err := replay(logbuf.Bytes()[:n]); err != nil || got != want {
+			t.Errorf("Error: %v, %v bytes: %v", err, n, got)
+		}
+	}
+
+	//So does a batch failing its checksum at the end of the log
+	corrupt := append([]byte(nil), logbuf.Bytes()...)
+	corrupt[12] ^= 0xff
+	if got, err := replay(corrupt); err != nil || got != want {
+		t.Errorf("Error: %v, got: %v", err, got)
+	}
+
+	//Anywhere else, it is an error
+	corrupt = append(corrupt, logbuf.Bytes()...)
+	if _, err := replay(corrupt); err != iptree.ErrInvalidData {
+		t.Error(err)
+	}
+}
@@ -3,6 +3,7 @@ package iptree
 import (
 	"bytes"
 	"net"
+	"strings"
 )
 
 func sameIPLen(x, y net.IPNet) bool {
@@ -21,3 +22,95 @@ func compareIP(x, y net.IP) int {
 func compareMask(x, y net.IPMask) int {
 	return bytes.Compare(x, y)
 }
+
+//containsNet reports whether x is a strict supernet of y
+func containsNet(x, y net.IPNet) bool {
+	return compareMask(x.Mask, y.Mask) < 0 && x.Contains(y.IP)
+}
+
+//parseCIDR parses s as a CIDR prefix with net.ParseCIDR, and returns the network.
+//Host bits are cleared, so 10.1.2.3/8 gives 10.0.0.0/8. The IP and mask are 4 bytes for
+//IPv4 text and 16 bytes for IPv6 text, including IPv4-mapped text such as ::ffff:1.2.3.0/120.
+func parseCIDR(s string) (net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return net.IPNet{}, err
+	}
+	return *ipnet, nil
+}
+
+//parseIP parses s as an IP address of length iplen, returning nil if it is not one.
+//IPv4 text is only accepted for a length of 4, and IPv6 text only for 16, so an IPv4
+//address is never silently taken as IPv4-mapped in an IPv6 tree.
+func parseIP(s string, iplen int) net.IP {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if isV6 := strings.Contains(s, ":"); isV6 != (iplen == net.IPv6len) {
+		return nil
+	}
+	if iplen == net.IPv4len {
+		return ip.To4()
+	}
+	return ip
+}
+
+//rangeToNets returns the smallest set of prefixes covering start to end, inclusive.
+//start and end must have the same length, and start must not be greater than end.
+func rangeToNets(start, end net.IP) []net.IPNet {
+	bits := len(start) * 8
+	cur := append(net.IP(nil), start...)
+	var nets []net.IPNet
+
+	for {
+		//Largest block aligned at cur, shrunk until it does not pass end
+		ones := bits - trailingZeros(cur)
+		var last net.IP
+		for {
+			mask := net.CIDRMask(ones, bits)
+			last = make(net.IP, len(cur))
+			for i := range cur {
+				last[i] = cur[i] | ^mask[i]
+			}
+			if compareIP(last, end) <= 0 {
+				nets = append(nets, net.IPNet{IP: cur, Mask: mask})
+				break
+			}
+			ones++
+		}
+
+		if compareIP(last, end) == 0 {
+			return nets
+		}
+		//Next block starts right after this one
+		cur = append(net.IP(nil), last...)
+		for i := len(cur) - 1; i >= 0; i-- {
+			cur[i]++
+			if cur[i] != 0 {
+				break
+			}
+		}
+	}
+}
+
+//trailingZeros returns the number of trailing zero bits in ip
+func trailingZeros(ip net.IP) int {
+	n := 0
+	for i := len(ip) - 1; i >= 0; i-- {
+		if ip[i] == 0 {
+			n += 8
+			continue
+		}
+		for b := ip[i]; b&1 == 0; b >>= 1 {
+			n++
+		}
+		break
+	}
+	return n
+}
+
+//netKey returns a string identifying ipnet, for use as a map key
+func netKey(ipnet net.IPNet) string {
+	return string(ipnet.IP) + string(ipnet.Mask)
+}
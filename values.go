@@ -0,0 +1,196 @@
+package iptree
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+)
+
+//Ready-made ValueSerializers and ValueDeserializers for common value types.
+//Each Serializer is paired with the Deserializer of the same name, for example:
+// iptree.Serialize(root, out, iptree.StringSerializer)
+// iptree.Deserialize(in, iptree.StringDeserializer)
+
+//StringSerializer serializes string values
+func StringSerializer(value interface{}) ([]byte, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, ErrValueType
+	}
+	return []byte(s), nil
+}
+
+//StringDeserializer deserializes values written by StringSerializer
+func StringDeserializer(vbytes []byte) (interface{}, error) {
+	return string(vbytes), nil
+}
+
+//IntSerializer serializes int values
+func IntSerializer(value interface{}) ([]byte, error) {
+	i, ok := value.(int)
+	if !ok {
+		return nil, ErrValueType
+	}
+	return Int64Serializer(int64(i))
+}
+
+//IntDeserializer deserializes values written by IntSerializer
+func IntDeserializer(vbytes []byte) (interface{}, error) {
+	i, err := Int64Deserializer(vbytes)
+	if err != nil {
+		return nil, err
+	}
+	return int(i.(int64)), nil
+}
+
+//Int64Serializer serializes int64 values
+func Int64Serializer(value interface{}) ([]byte, error) {
+	i, ok := value.(int64)
+	if !ok {
+		return nil, ErrValueType
+	}
+	vbytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(vbytes, uint64(i))
+	return vbytes, nil
+}
+
+//Int64Deserializer deserializes values written by Int64Serializer
+func Int64Deserializer(vbytes []byte) (interface{}, error) {
+	if len(vbytes) != 8 {
+		return nil, ErrInvalidData
+	}
+	return int64(binary.BigEndian.Uint64(vbytes)), nil
+}
+
+//BytesSerializer serializes []byte values
+func BytesSerializer(value interface{}) ([]byte, error) {
+	b, ok := value.([]byte)
+	if !ok {
+		return nil, ErrValueType
+	}
+	return b, nil
+}
+
+//BytesDeserializer deserializes values written by BytesSerializer.
+//The returned slice is a copy, as Deserialize reuses its buffer between values.
+func BytesDeserializer(vbytes []byte) (interface{}, error) {
+	return append([]byte{}, vbytes...), nil
+}
+
+//BinaryMarshalerSerializer serializes values implementing encoding.BinaryMarshaler
+func BinaryMarshalerSerializer(value interface{}) ([]byte, error) {
+	m, ok := value.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, ErrValueType
+	}
+	return m.MarshalBinary()
+}
+
+//BinaryUnmarshalerDeserializer returns a ValueDeserializer that calls UnmarshalBinary
+//on a new value from newValue, and returns that value
+func BinaryUnmarshalerDeserializer(newValue func() encoding.BinaryUnmarshaler) ValueDeserializer {
+	return func(vbytes []byte) (interface{}, error) {
+		value := newValue()
+		if err := value.UnmarshalBinary(vbytes); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+}
+
+//GobSerializer serializes values with encoding/gob
+func GobSerializer(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//GobDeserializer returns a ValueDeserializer that decodes values written by GobSerializer.
+//newValue must return a pointer to the type that was serialized, such as new(MyType);
+//the value it points to is returned.
+func GobDeserializer(newValue func() interface{}) ValueDeserializer {
+	return func(vbytes []byte) (interface{}, error) {
+		ptr := newValue()
+		if err := gob.NewDecoder(bytes.NewReader(vbytes)).Decode(ptr); err != nil {
+			return nil, err
+		}
+		return deref(ptr)
+	}
+}
+
+//JSONSerializer serializes values with encoding/json
+func JSONSerializer(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+//JSONDeserializer returns a ValueDeserializer that decodes values written by JSONSerializer.
+//newValue must return a pointer to the type that was serialized; the value it points to is returned.
+//If newValue is nil, values are decoded into an interface{} as described by json.Unmarshal.
+func JSONDeserializer(newValue func() interface{}) ValueDeserializer {
+	return func(vbytes []byte) (interface{}, error) {
+		if newValue == nil {
+			var value interface{}
+			err := json.Unmarshal(vbytes, &value)
+			return value, err
+		}
+		ptr := newValue()
+		if err := json.Unmarshal(vbytes, ptr); err != nil {
+			return nil, err
+		}
+		return deref(ptr)
+	}
+}
+
+//NilAwareSerializer wraps serializer so that nil values are written without calling it.
+//Nil pointers, maps, slices, channels and funcs are nil values too, and read back as nil
+func NilAwareSerializer(serializer ValueSerializer) ValueSerializer {
+	return func(value interface{}) ([]byte, error) {
+		if isNil(value) {
+			return []byte{0}, nil
+		}
+		vbytes, err := serializer(value)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{1}, vbytes...), nil
+	}
+}
+
+//isNil reports whether value is nil, or a nil of a type that can be
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	switch v := reflect.ValueOf(value); v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Chan, reflect.Func:
+		return v.IsNil()
+	}
+	return false
+}
+
+//NilAwareDeserializer wraps deserializer to read values written by NilAwareSerializer
+func NilAwareDeserializer(deserializer ValueDeserializer) ValueDeserializer {
+	return func(vbytes []byte) (interface{}, error) {
+		if len(vbytes) == 0 {
+			return nil, ErrInvalidData
+		}
+		if vbytes[0] == 0 {
+			return nil, nil
+		}
+		return deserializer(vbytes[1:])
+	}
+}
+
+//deref returns the value ptr points to
+func deref(ptr interface{}) (interface{}, error) {
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil, ErrValueType
+	}
+	return v.Elem().Interface(), nil
+}
@@ -0,0 +1,95 @@
+package iptree_test
+
+import (
+	"bytes"
+	"encoding"
+	"net"
+	"reflect"
+	"testing"
+
+	"iptree"
+)
+
+type gobValue struct {
+	Name string
+	ASN  uint32
+}
+
+type binValue struct {
+	ASN uint16
+}
+
+func (v *binValue) MarshalBinary() ([]byte, error) {
+	return []byte{byte(v.ASN >> 8), byte(v.ASN)}, nil
+}
+
+func (v *binValue) UnmarshalBinary(b []byte) error {
+	if len(b) != 2 {
+		return iptree.ErrInvalidData
+	}
+	v.ASN = uint16(b[0])<<8 | uint16(b[1])
+	return nil
+}
+
+func TestValueSerializers(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		value        interface{}
+		serializer   iptree.ValueSerializer
+		deserializer iptree.ValueDeserializer
+	}{
+		{"string", "hello", iptree.StringSerializer, iptree.StringDeserializer},
+		{"int", -42, iptree.IntSerializer, iptree.IntDeserializer},
+		{"int64", int64(1) << 40, iptree.Int64Serializer, iptree.Int64Deserializer},
+		{"bytes", []byte{1, 2, 3}, iptree.BytesSerializer, iptree.BytesDeserializer},
+		{"binary", &binValue{64512}, iptree.BinaryMarshalerSerializer, iptree.BinaryUnmarshalerDeserializer(func() encoding.BinaryUnmarshaler { return new(binValue) })},
+		{"gob", gobValue{"office", 64512}, iptree.GobSerializer, iptree.GobDeserializer(func() interface{} { return new(gobValue) })},
+		{"json", gobValue{"office", 64512}, iptree.JSONSerializer, iptree.JSONDeserializer(func() interface{} { return new(gobValue) })},
+		{"nil", nil, iptree.NilAwareSerializer(iptree.StringSerializer), iptree.NilAwareDeserializer(iptree.StringDeserializer)},
+		{"not nil", "x", iptree.NilAwareSerializer(iptree.StringSerializer), iptree.NilAwareDeserializer(iptree.StringDeserializer)},
+	} {
+		//Round trip a tree with the value on a child
+		tree := iptree.NewDefaultRoot(net.IPv4len, c.value)
+		err := tree.Insert(net.IPNet{
+			IP:   []byte{10, 0, 0, 0},
+			Mask: []byte{255, 0, 0, 0},
+		}, c.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var sbuf bytes.Buffer
+		if err := iptree.Serialize(tree, &sbuf, c.serializer); err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		tree, err = iptree.Deserialize(&sbuf, c.deserializer)
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+
+		err = tree.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+			if !reflect.DeepEqual(value, c.value) {
+				t.Errorf("%v: got %#v", c.name, value)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	//Typed nils are written as nil, without calling the wrapped serializer
+	nilAware := iptree.NilAwareSerializer(iptree.BinaryMarshalerSerializer)
+	for _, v := range []interface{}{(*binValue)(nil), encoding.BinaryMarshaler((*binValue)(nil)), map[string]int(nil), []byte(nil)} {
+		if vbytes, err := nilAware(v); err != nil || !bytes.Equal(vbytes, []byte{0}) {
+			t.Errorf("%T: %v, %v", v, vbytes, err)
+		}
+	}
+
+	//Wrong type (expect error)
+	if _, err := iptree.StringSerializer(5); err != iptree.ErrValueType {
+		t.Error(err)
+	}
+}
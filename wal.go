@@ -0,0 +1,463 @@
+package iptree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"net"
+)
+
+//wop - mutation log operations
+//one byte at the start of every record
+const (
+	wopInsert byte = iota + 1
+	wopRemove
+	wopRemoveSubtree
+	wopPrune
+	wopRemoveElement
+	wopBatch
+)
+
+//syncer is implemented by writers that can flush to stable storage, such as *os.File
+type syncer interface {
+	Sync() error
+}
+
+//MutationLog is an append-only log of operations that change a tree.
+//Records use the same IP, mask and value encoding as Serialize. The records of a single
+//operation that makes several changes, such as RemoveIf or a committed Tx, are written as
+//one batch with a count, length and CRC-32 checksum, so replay applies all of them or none.
+type MutationLog struct {
+	w          io.Writer
+	serializer ValueSerializer
+
+	//SyncWrites syncs the writer after every record, if it has a Sync method
+	SyncWrites bool
+}
+
+//NewMutationLog returns a MutationLog appending records to w.
+//serializer must be able to serialize every inserted value.
+func NewMutationLog(w io.Writer, serializer ValueSerializer) *MutationLog {
+	return &MutationLog{w: w, serializer: serializer}
+}
+
+//LogInsert appends an insert record
+func (l *MutationLog) LogInsert(ipnet net.IPNet, value interface{}) error {
+	return l.write([]txOp{{wopInsert, ipnet, value}})
+}
+
+//LogRemove appends a remove record
+func (l *MutationLog) LogRemove(ipnet net.IPNet) error {
+	return l.write([]txOp{{wopRemove, ipnet, nil}})
+}
+
+//LogRemoveElement appends a record removing a single element, whose children are kept
+func (l *MutationLog) LogRemoveElement(ipnet net.IPNet) error {
+	return l.write([]txOp{{wopRemoveElement, ipnet, nil}})
+}
+
+//LogRemoveSubtree appends a subtree removal record
+func (l *MutationLog) LogRemoveSubtree(ipnet net.IPNet) error {
+	return l.write([]txOp{{wopRemoveSubtree, ipnet, nil}})
+}
+
+//LogPrune appends a prune record
+func (l *MutationLog) LogPrune(maxDepth int) error {
+	return l.write([]txOp{{wopPrune, net.IPNet{}, maxDepth}})
+}
+
+//write appends a record for each op, framed as a batch if there is more than one.
+//The records are built in memory first so they reach the writer in one call.
+func (l *MutationLog) write(ops []txOp) error {
+	var buf bytes.Buffer
+	for _, op := range ops {
+		if err := l.encode(&buf, op); err != nil {
+			return err
+		}
+	}
+
+	record := buf.Bytes()
+	if len(ops) > 1 {
+		batch := make([]byte, 9, 9+len(record)+4)
+		batch[0] = wopBatch
+		binary.BigEndian.PutUint32(batch[1:], uint32(len(ops)))
+		binary.BigEndian.PutUint32(batch[5:], uint32(len(record)))
+		batch = append(batch, record...)
+		record = binary.BigEndian.AppendUint32(batch, crc32.ChecksumIEEE(record))
+	}
+
+	if _, err := l.w.Write(record); err != nil {
+		return err
+	}
+	if s, ok := l.w.(syncer); ok && l.SyncWrites {
+		return s.Sync()
+	}
+	return nil
+}
+
+//encode writes a single record for op to buf
+func (l *MutationLog) encode(buf *bytes.Buffer, op txOp) error {
+	buf.WriteByte(op.op)
+	if op.op == wopPrune {
+		//Any depth beyond the longest prefix prunes nothing, so clamping keeps its meaning
+		depth := op.value.(int)
+		if depth < -1 {
+			depth = -1
+		} else if depth > math.MaxInt16 {
+			depth = math.MaxInt16
+		}
+		return binary.Write(buf, binary.BigEndian, int16(depth))
+	}
+
+	if len(op.ipnet.IP) > 255 || len(op.ipnet.Mask) != len(op.ipnet.IP) {
+		return ErrWrongIPLength
+	}
+	buf.WriteByte(byte(len(op.ipnet.IP)))
+	if err := writeNet(buf, op.ipnet); err != nil {
+		return err
+	}
+	if op.op != wopInsert {
+		return nil
+	}
+	return writeValue(buf, op.value, l.serializer)
+}
+
+//loggedRoot is a Root that records every successful change to a MutationLog
+type loggedRoot struct {
+	Root
+	log *MutationLog
+
+	//stale is set once a committed transaction has replaced this root
+	stale bool
+}
+
+//Attach returns a Root that applies every operation to root, and records every
+//successful change in log. Each record is written before the change is applied, so if
+//the write fails the tree is left unchanged and the error is returned. A change that would
+//remove the root element is refused with ErrRemoveLoggedRoot, as replaying it would leave
+//no tree to apply later records to. New roots returned in ErrNewRoot are attached to the
+//same log. Once a Tx on the
+//returned root is committed, only the root returned by Commit is attached, and
+//changing the original returns ErrStaleRoot.
+func Attach(root Root, log *MutationLog) Root {
+	return &loggedRoot{Root: root, log: log}
+}
+
+func (l *loggedRoot) FindMatch(ipnet net.IPNet, allowSupernet bool) (net.IPNet, interface{}, error) {
+	return FindMatch(l.Root, ipnet, allowSupernet)
+}
+
+func (l *loggedRoot) Insert(ipnet net.IPNet, value interface{}) error {
+	return l.mutate(insertion(ipnet, value), nil)
+}
+
+func (l *loggedRoot) Update(ipnet net.IPNet, f Updater) error {
+	return l.mutate(mutation{op: mopUpdate, ipnet: ipnet, updater: f}, nil)
+}
+
+func (l *loggedRoot) Remove(ipnet net.IPNet) error {
+	return l.mutate(mutation{op: mopRemove, ipnet: ipnet}, nil)
+}
+
+func (l *loggedRoot) RemoveSubtree(ipnet net.IPNet) error {
+	return l.mutate(mutation{op: mopRemoveSubtree, ipnet: ipnet}, nil)
+}
+
+//RemoveIf logs an element removal record for every matched element. Replaying
+//them in the order the Predicate matched gives the same tree.
+func (l *loggedRoot) RemoveIf(pred Predicate) error {
+	return l.mutate(mutation{op: mopRemoveIf, pred: pred}, nil)
+}
+
+func (l *loggedRoot) Prune(maxDepth int) error {
+	return l.mutate(mutation{op: mopPrune, maxDepth: maxDepth}, nil)
+}
+
+//mutate logs m and then applies it. Anything that would make m fail, or remove the
+//root element, is checked before logging, so a change is only logged if it is applied.
+func (l *loggedRoot) mutate(m mutation, c *changeLog) error {
+	if l.stale {
+		return ErrStaleRoot
+	}
+	var err error
+	switch m.op {
+	case mopUpdate:
+		return l.update(m, c)
+	case mopRemove, mopRemoveSubtree:
+		if _, err := l.Root.Find(m.ipnet, false); err != nil {
+			return err
+		}
+		if l.isTop(m.ipnet) {
+			return ErrRemoveLoggedRoot
+		}
+		op := wopRemove
+		if m.op == mopRemoveSubtree {
+			op = wopRemoveSubtree
+		}
+		err = l.log.write([]txOp{{op, m.ipnet, nil}})
+	case mopRemoveIf:
+		//Find the matches first, then remove exactly those
+		var ops []txOp
+		matched := make(map[string]bool)
+		if err := l.Root.Traverse(func(ipnet net.IPNet, value interface{}, distance int) error {
+			if m.pred(ipnet, value) {
+				if distance == 0 {
+					return ErrRemoveLoggedRoot
+				}
+				ops = append(ops, txOp{wopRemoveElement, ipnet, nil})
+				matched[netKey(ipnet)] = true
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if len(ops) == 0 {
+			return nil
+		}
+		err = l.log.write(ops)
+		m.pred = func(ipnet net.IPNet, value interface{}) bool {
+			return matched[netKey(ipnet)]
+		}
+	case mopPrune:
+		if m.maxDepth < 0 {
+			return ErrRemoveLoggedRoot
+		}
+		err = l.log.LogPrune(m.maxDepth)
+	}
+	if err != nil {
+		return err
+	}
+	return l.wrapRoots(mutate(l.Root, m, c))
+}
+
+//isTop reports whether removing ipnet would remove the root element
+func (l *loggedRoot) isTop(ipnet net.IPNet) bool {
+	top := topIPNet(l.Root)
+	return sameIPLen(ipnet, top) && onPath(ipnet, top)
+}
+
+//update logs the result of the Updater from inside it, before the tree applies it.
+//If the write fails, or the Updater would remove the root element, the Updater leaves
+//the element as it was.
+func (l *loggedRoot) update(m mutation, c *changeLog) error {
+	var lerr error
+	logged, existed := false, false
+	var oldValue interface{}
+	f := m.updater
+	m.updater = func(value interface{}, exists bool) (interface{}, bool) {
+		newValue, keep := f(value, exists)
+		switch {
+		case keep:
+			lerr = l.log.LogInsert(m.ipnet, newValue)
+		case exists && l.isTop(m.ipnet):
+			lerr = ErrRemoveLoggedRoot
+		case exists:
+			lerr = l.log.LogRemoveElement(m.ipnet)
+		default:
+			return newValue, keep
+		}
+		if lerr != nil {
+			return value, exists
+		}
+		logged, existed, oldValue = true, exists, value
+		return newValue, keep
+	}
+	err := mutate(l.Root, m, c)
+	if lerr != nil {
+		return lerr
+	}
+	if logged && !succeeded(err) {
+		//Only a Root from outside this package can fail after calling the Updater.
+		//Log the element as it was, so replaying the log gives the same tree.
+		if existed {
+			l.log.LogInsert(m.ipnet, oldValue)
+		} else {
+			l.log.LogRemoveElement(m.ipnet)
+		}
+	}
+	return l.wrapRoots(err)
+}
+
+//wrapRoots attaches a new root in err to the same log
+func (l *loggedRoot) wrapRoots(err error) error {
+	if e, ok := err.(ErrNewRoot); ok {
+		return ErrNewRoot{&loggedRoot{Root: e.NewRoot, log: l.log}}
+	}
+	return err
+}
+
+func (l *loggedRoot) unwrap() Root {
+	return l.Root
+}
+
+//rewrap logs every op of a committed transaction as one batch
+func (l *loggedRoot) rewrap(root Root, ops []txOp, events []Event) (Root, error) {
+	if l.stale {
+		return nil, ErrStaleRoot
+	}
+	if err := l.log.write(ops); err != nil {
+		return nil, err
+	}
+	return &loggedRoot{Root: root, log: l.log}, nil
+}
+
+func (l *loggedRoot) retire(events []Event) {
+	l.stale = true
+}
+
+//replayLog applies every record in log to root, returning the resulting root.
+//A torn record or batch at the end of the log, left by a crash during a write, is ignored.
+func replayLog(root Root, log io.Reader, deserializer ValueDeserializer) (Root, error) {
+	var vbuf []byte
+	for {
+		var op [1]byte
+		if _, err := io.ReadFull(log, op[:]); isTorn(err) {
+			return root, nil
+		} else if err != nil {
+			return root, err
+		}
+
+		var ops []txOp
+		var err error
+		if op[0] == wopBatch {
+			ops, err = readBatch(log, deserializer)
+		} else {
+			var o txOp
+			o, vbuf, err = readRecord(log, op[0], vbuf, deserializer)
+			ops = []txOp{o}
+		}
+		if isTorn(err) {
+			return root, nil
+		} else if err != nil {
+			return root, err
+		}
+
+		for _, o := range ops {
+			if root, err = replayOp(root, o); err != nil {
+				return root, err
+			}
+		}
+	}
+}
+
+//readRecord reads the rest of a single record, after its op byte
+func readRecord(log io.Reader, op byte, vbuf []byte, deserializer ValueDeserializer) (txOp, []byte, error) {
+	switch op {
+	case wopPrune:
+		var depth int16
+		err := binary.Read(log, binary.BigEndian, &depth)
+		return txOp{op, net.IPNet{}, int(depth)}, vbuf, err
+	case wopInsert, wopRemove, wopRemoveSubtree, wopRemoveElement:
+	default:
+		return txOp{}, vbuf, ErrInvalidData
+	}
+
+	var iplen [1]byte
+	if _, err := io.ReadFull(log, iplen[:]); err != nil {
+		return txOp{}, vbuf, err
+	}
+	ipnet, err := readNet(log, int(iplen[0]))
+	if err != nil || op != wopInsert {
+		return txOp{op, ipnet, nil}, vbuf, err
+	}
+	var value interface{}
+	value, vbuf, err = readValue(log, vbuf, deserializer)
+	return txOp{op, ipnet, value}, vbuf, err
+}
+
+//readBatch reads the records of a batch, after its op byte. A batch that is cut short
+//or fails its checksum at the end of the log was torn by a crash, and returns io.ErrUnexpectedEOF.
+func readBatch(log io.Reader, deserializer ValueDeserializer) ([]txOp, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(log, header[:]); isTorn(err) {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	count := binary.BigEndian.Uint32(header[:4])
+	length := int64(binary.BigEndian.Uint32(header[4:]))
+
+	//Read through a LimitReader, so a corrupt length cannot allocate more than the log holds
+	var body bytes.Buffer
+	if n, err := body.ReadFrom(io.LimitReader(log, length+4)); err != nil {
+		return nil, err
+	} else if n < length+4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	records, sum := body.Bytes()[:length], body.Bytes()[length:]
+	if crc32.ChecksumIEEE(records) != binary.BigEndian.Uint32(sum) {
+		var next [1]byte
+		if _, err := io.ReadFull(log, next[:]); err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, ErrInvalidData
+	}
+
+	r := bytes.NewReader(records)
+	var ops []txOp
+	var vbuf []byte
+	for i := uint32(0); i < count; i++ {
+		op, err := r.ReadByte()
+		if err != nil || op == wopBatch {
+			return nil, ErrInvalidData
+		}
+		var o txOp
+		if o, vbuf, err = readRecord(r, op, vbuf, deserializer); isTorn(err) {
+			return nil, ErrInvalidData
+		} else if err != nil {
+			return nil, err
+		}
+		ops = append(ops, o)
+	}
+	if r.Len() != 0 {
+		return nil, ErrInvalidData
+	}
+	return ops, nil
+}
+
+//replayOp applies a single logged op to root, returning the resulting root
+func replayOp(root Root, op txOp) (Root, error) {
+	switch op.op {
+	case wopInsert:
+		err := root.Insert(op.ipnet, op.value)
+		if nr, ok := err.(ErrNewRoot); ok {
+			return nr.NewRoot, nil
+		}
+		return root, err
+	case wopRemove:
+		return root, root.Remove(op.ipnet)
+	case wopRemoveSubtree:
+		return root, RemoveSubtree(root, op.ipnet)
+	case wopRemoveElement:
+		return root, Update(root, op.ipnet, func(interface{}, bool) (interface{}, bool) {
+			return nil, false
+		})
+	case wopPrune:
+		return root, Prune(root, op.value.(int))
+	}
+	return root, ErrInvalidData
+}
+
+//isTorn reports whether err means the log ended, possibly part way through a record
+func isTorn(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+//Compact loads the newest snapshot, applies every record in log to it and saves
+//the result as a new snapshot, which is returned. Once Compact succeeds, the log
+//is no longer needed and may be truncated.
+func (s *SnapshotStore) Compact(log io.Reader) (Root, error) {
+	root, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+	if root, err = replayLog(root, log, s.Deserializer); err != nil {
+		return nil, err
+	}
+	if err := s.Save(root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
@@ -0,0 +1,283 @@
+package iptree_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"iptree"
+)
+
+func TestMutationLog(t *testing.T) {
+	tree := buildStreamTree(t)
+
+	var snapshot bytes.Buffer
+	if err := iptree.Serialize(tree, &snapshot, iptree.StringSerializer); err != nil {
+		t.Fatal(err)
+	}
+
+	var logbuf bytes.Buffer
+	log := iptree.NewMutationLog(&logbuf, iptree.StringSerializer)
+	tree = iptree.Attach(tree, log)
+
+	//Insert 10.1.2.0/24, overwrite 10.0.0.0/8, remove 10.2.0.0/16
+	_, ipnet, _ := net.ParseCIDR("10.1.2.0/24")
+	if err := tree.Insert(*ipnet, "10.1.2.0/24"); err != nil {
+		t.Error(err)
+	}
+	_, ipnet, _ = net.ParseCIDR("10.0.0.0/8")
+	if err := tree.Insert(*ipnet, "ten"); err != nil {
+		t.Error(err)
+	}
+	_, ipnet, _ = net.ParseCIDR("10.2.0.0/16")
+	if err := tree.Remove(*ipnet); err != nil {
+		t.Error(err)
+	}
+
+	//Remove every /24, then 10.0.0.0/8, then everything below depth 2
+	err := iptree.RemoveIf(tree, func(ipnet net.IPNet, value interface{}) bool {
+		ones, _ := ipnet.Mask.Size()
+		return ones == 24
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	//Remove 10.0.0.0/8 alone, keeping its children
+	_, ipnet, _ = net.ParseCIDR("10.0.0.0/8")
+	err = iptree.Update(tree, *ipnet, func(interface{}, bool) (interface{}, bool) {
+		return nil, false
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if err := iptree.Prune(tree, 2); err != nil {
+		t.Error(err)
+	}
+
+	//Failed operations are not logged
+	_, ipnet, _ = net.ParseCIDR("10.9.0.0/16")
+	if err := tree.Remove(*ipnet); err != iptree.ErrNotFound {
+		t.Error(err)
+	}
+
+	want, err := traverseString(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != "0.0.0.0/0: default\n 10.1.0.0/16: 10.1.0.0/16\n  10.1.1.128/25: 10.1.1.128/25\n 192.168.0.0/16: 192.168.0.0/16\n" {
+		t.Error(want)
+	}
+
+	//Simulate a crash part way through the next record
+	full := logbuf.Len()
+	_, ipnet, _ = net.ParseCIDR("10.3.0.0/16")
+	if err := tree.Insert(*ipnet, "lost"); err != nil {
+		t.Error(err)
+	}
+	logbuf.Truncate(full + 5)
+
+	replayed, err := iptree.Replay(bytes.NewReader(snapshot.Bytes()), bytes.NewReader(logbuf.Bytes()), iptree.StringDeserializer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := traverseString(replayed)
+	if err != nil {
+		t.Error(err)
+	}
+	if got != want {
+		t.Error(got)
+	}
+
+	//A new root is still logged
+	logbuf.Truncate(full)
+	tree = iptree.Attach(iptree.NewRoot(net.IPNet{
+		IP:   []byte{10, 0, 0, 0},
+		Mask: []byte{255, 0, 0, 0},
+	}, "ten"), log)
+	err = tree.Insert(net.IPNet{
+		IP:   []byte{0, 0, 0, 0},
+		Mask: []byte{0, 0, 0, 0},
+	}, "default")
+	if reflect.TypeOf(err) != reflect.TypeOf(iptree.ErrNewRoot{}) {
+		t.Fatal(err)
+	}
+	tree = err.(iptree.ErrNewRoot).NewRoot
+	if err := tree.Insert(*ipnet, "10.3.0.0/16"); err != nil {
+		t.Error(err)
+	}
+	if logbuf.Len() <= full {
+		t.Error("New root was not logged")
+	}
+}
+
+//failWriter fails every write once fail is set
+type failWriter struct {
+	bytes.Buffer
+	fail bool
+}
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	if w.fail {
+		return 0, errors.New("disk full")
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestMutationLogWriteFailure(t *testing.T) {
+	var w failWriter
+	tree := iptree.Attach(buildStreamTree(t), iptree.NewMutationLog(&w, iptree.StringSerializer))
+	before, _ := traverseString(tree)
+
+	//Every change is refused and leaves the tree as it was
+	w.fail = true
+	_, ipnet, _ := net.ParseCIDR("10.1.0.0/16")
+	_, ipnet2, _ := net.ParseCIDR("10.3.0.0/16")
+	if err := tree.Insert(*ipnet, "changed"); err == nil {
+		t.Error("Overwrite succeeded")
+	}
+	if err := tree.Insert(*ipnet2, "new"); err == nil {
+		t.Error("Insert succeeded")
+	}
+	if err := tree.Remove(*ipnet); err == nil {
+		t.Error("Remove succeeded")
+	}
+	err := iptree.Update(tree, *ipnet, func(interface{}, bool) (interface{}, bool) {
+		return nil, false
+	})
+	if err == nil {
+		t.Error("Update succeeded")
+	}
+	err = iptree.RemoveIf(tree, func(ipnet net.IPNet, value interface{}) bool {
+		return true
+	})
+	if err == nil {
+		t.Error("RemoveIf succeeded")
+	}
+	if err := iptree.Prune(tree, 0); err == nil {
+		t.Error("Prune succeeded")
+	}
+	if after, _ := traverseString(tree); after != before {
+		t.Error(after)
+	}
+	if w.Len() != 0 {
+		t.Errorf("Logged %v bytes", w.Len())
+	}
+}
+
+func TestSnapshotStoreCompact(t *testing.T) {
+	store := iptree.NewSnapshotStore(t.TempDir(), 2, iptree.StringSerializer, iptree.StringDeserializer)
+	tree := buildStreamTree(t)
+	if err := store.Save(tree); err != nil {
+		t.Fatal(err)
+	}
+
+	var logbuf bytes.Buffer
+	tree = iptree.Attach(tree, iptree.NewMutationLog(&logbuf, iptree.StringSerializer))
+	_, ipnet, _ := net.ParseCIDR("172.16.0.0/12")
+	if err := tree.Insert(*ipnet, "172.16.0.0/12"); err != nil {
+		t.Fatal(err)
+	}
+
+	compacted, err := store.Compact(&logbuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := traverseString(tree)
+	for _, r := range []iptree.Root{compacted, loaded} {
+		if got, _ := traverseString(r); got != want {
+			t.Error(got)
+		}
+	}
+}
+
+func TestMutationLogRootRemoval(t *testing.T) {
+	store := iptree.NewSnapshotStore(t.TempDir(), 2, iptree.StringSerializer, iptree.StringDeserializer)
+	_, ten, _ := net.ParseCIDR("10.0.0.0/8")
+	tree := iptree.NewRoot(*ten, "ten")
+	if err := store.Save(tree); err != nil {
+		t.Fatal(err)
+	}
+
+	var logbuf bytes.Buffer
+	tree = iptree.Attach(tree, iptree.NewMutationLog(&logbuf, iptree.StringSerializer))
+	_, ipnet, _ := net.ParseCIDR("10.1.0.0/16")
+	if err := tree.Insert(*ipnet, "10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	full := logbuf.Len()
+
+	//Every way of removing the root is refused before anything is logged (expect errors)
+	if err := tree.Remove(*ten); err != iptree.ErrRemoveLoggedRoot {
+		t.Error(err)
+	}
+	if err := iptree.RemoveSubtree(tree, *ten); err != iptree.ErrRemoveLoggedRoot {
+		t.Error(err)
+	}
+	err := iptree.Update(tree, *ten, func(interface{}, bool) (interface{}, bool) {
+		return nil, false
+	})
+	if err != iptree.ErrRemoveLoggedRoot {
+		t.Error(err)
+	}
+	err = iptree.RemoveIf(tree, func(ipnet net.IPNet, value interface{}) bool {
+		return true
+	})
+	if err != iptree.ErrRemoveLoggedRoot {
+		t.Error(err)
+	}
+	if err := iptree.Prune(tree, -1); err != iptree.ErrRemoveLoggedRoot {
+		t.Error(err)
+	}
+	if logbuf.Len() != full {
+		t.Errorf("Logged %v bytes", logbuf.Len()-full)
+	}
+
+	//The tree is still logged, and the log can still be compacted
+	_, ipnet, _ = net.ParseCIDR("10.2.0.0/16")
+	if err := tree.Insert(*ipnet, "10.2.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := traverseString(tree)
+	if want != "10.0.0.0/8: ten\n 10.1.0.0/16: 10.1.0.0/16\n 10.2.0.0/16: 10.2.0.0/16\n" {
+		t.Error(want)
+	}
+	compacted, err := store.Compact(bytes.NewReader(logbuf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := traverseString(compacted); got != want {
+		t.Error(got)
+	}
+}
+
+func TestMutationLogPruneDepth(t *testing.T) {
+	tree := buildStreamTree(t)
+	var snapshot bytes.Buffer
+	if err := iptree.Serialize(tree, &snapshot, iptree.StringSerializer); err != nil {
+		t.Fatal(err)
+	}
+	var logbuf bytes.Buffer
+	tree = iptree.Attach(tree, iptree.NewMutationLog(&logbuf, iptree.StringSerializer))
+
+	//Depths past the longest prefix prune nothing, live or replayed
+	for _, depth := range []int{1 << 16, 65535, 1<<31 - 1, 40} {
+		if err := iptree.Prune(tree, depth); err != nil {
+			t.Error(err)
+		}
+	}
+	want, _ := traverseString(tree)
+	replayed, err := iptree.Replay(bytes.NewReader(snapshot.Bytes()), bytes.NewReader(logbuf.Bytes()), iptree.StringDeserializer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := traverseString(replayed); got != want {
+		t.Error(got)
+	}
+}
@@ -0,0 +1,215 @@
+package iptree
+
+import (
+	"net"
+	"sync"
+)
+
+//EventType is the kind of change an Event describes
+type EventType int
+
+//Event types
+const (
+	//EventInserted is sent when a new element is inserted
+	EventInserted EventType = iota
+	//EventRemoved is sent when an element is removed
+	EventRemoved
+	//EventValueChanged is sent when the value of an existing element is replaced
+	EventValueChanged
+	//EventReparented is sent when an element moves to a new parent,
+	//because its parent was removed or a new element was inserted between them
+	EventReparented
+)
+
+//Event describes a single change to an element of a watched tree
+type Event struct {
+	Type     EventType
+	IPNet    net.IPNet
+	Value    interface{} //The value after the change, or the removed value
+	OldValue interface{} //The value before the change, for EventValueChanged only
+	Parent   net.IPNet   //The new parent, for EventReparented only. Zero if the element is now a root
+}
+
+//WatchedRoot is a Root that sends Events to subscribers whenever it changes.
+//Events are sent after each operation completes, from the goroutine that called it.
+//They are reported by the tree as it changes, so only a Root from outside this package,
+//which cannot report its changes, is compared before and after every operation.
+//Elements that expire from a TTLRoot inside a WatchedRoot are not seen; to watch
+//expiries, wrap the WatchedRoot with WithTTL instead.
+//New roots returned in ErrNewRoot and ErrRemovedRoot are WatchedRoots sharing the same subscribers.
+//Once a Tx on a WatchedRoot is committed, the subscribers move to the root returned by Commit,
+//and changing the original returns ErrStaleRoot.
+type WatchedRoot struct {
+	Root
+	subs *subscribers
+
+	//stale is set once a committed transaction has replaced this root
+	stale bool
+}
+
+//subscribers is the set of subscriptions shared by a WatchedRoot and any roots it creates
+type subscribers struct {
+	mu   sync.Mutex
+	next int
+	subs map[int]*subscription
+}
+
+//subscription is interest in a prefix and everything beneath it
+type subscription struct {
+	prefix net.IPNet
+	f      func(Event)
+}
+
+//Watch returns a WatchedRoot that applies every operation to root
+func Watch(root Root) *WatchedRoot {
+	return &WatchedRoot{Root: root, subs: &subscribers{subs: make(map[int]*subscription)}}
+}
+
+//Subscribe calls f for every Event on prefix or any prefix beneath it, until cancel is called.
+//f is called synchronously, so it must not change the tree.
+func (w *WatchedRoot) Subscribe(prefix net.IPNet, f func(Event)) (cancel func()) {
+	s := w.subs
+	s.mu.Lock()
+	id := s.next
+	s.next++
+	s.subs[id] = &subscription{prefix, f}
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		delete(s.subs, id)
+		s.mu.Unlock()
+	}
+}
+
+//SubscribeChan is the same as Subscribe, but sends every Event on the returned channel.
+//Sending blocks the operation that caused the Event until it is received, or until cancel is
+//called, so the channel must be drained. cancel closes the channel.
+func (w *WatchedRoot) SubscribeChan(prefix net.IPNet, buffer int) (events <-chan Event, cancel func()) {
+	ch := make(chan Event, buffer)
+	done := make(chan struct{})
+	var mu sync.Mutex
+	closed := false
+
+	unsubscribe := w.Subscribe(prefix, func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case ch <- e:
+		case <-done:
+		}
+	})
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			unsubscribe()
+			close(done) //Unblock a pending send before taking the lock
+			mu.Lock()
+			closed = true
+			close(ch)
+			mu.Unlock()
+		})
+	}
+}
+
+//dispatch sends every event to each matching subscriber
+func (s *subscribers) dispatch(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	s.mu.Lock()
+	subs := make([]*subscription, 0, len(s.subs))
+	for _, sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	s.mu.Unlock()
+
+	for _, e := range events {
+		for _, sub := range subs {
+			if sameIPLen(sub.prefix, e.IPNet) && onPath(sub.prefix, e.IPNet) {
+				sub.f(e)
+			}
+		}
+	}
+}
+
+func (w *WatchedRoot) FindMatch(ipnet net.IPNet, allowSupernet bool) (net.IPNet, interface{}, error) {
+	return FindMatch(w.Root, ipnet, allowSupernet)
+}
+
+func (w *WatchedRoot) Insert(ipnet net.IPNet, value interface{}) error {
+	return w.mutate(insertion(ipnet, value), nil)
+}
+
+func (w *WatchedRoot) Update(ipnet net.IPNet, f Updater) error {
+	return w.mutate(mutation{op: mopUpdate, ipnet: ipnet, updater: f}, nil)
+}
+
+func (w *WatchedRoot) Remove(ipnet net.IPNet) error {
+	return w.mutate(mutation{op: mopRemove, ipnet: ipnet}, nil)
+}
+
+func (w *WatchedRoot) RemoveSubtree(ipnet net.IPNet) error {
+	return w.mutate(mutation{op: mopRemoveSubtree, ipnet: ipnet}, nil)
+}
+
+func (w *WatchedRoot) RemoveIf(pred Predicate) error {
+	return w.mutate(mutation{op: mopRemoveIf, pred: pred}, nil)
+}
+
+func (w *WatchedRoot) Prune(maxDepth int) error {
+	return w.mutate(mutation{op: mopPrune, maxDepth: maxDepth}, nil)
+}
+
+//mutate applies m to the wrapped Root, which reports the Events to send
+func (w *WatchedRoot) mutate(m mutation, c *changeLog) error {
+	if w.stale {
+		return ErrStaleRoot
+	}
+	var changes changeLog
+	err := mutate(w.Root, m, &changes)
+	if !succeeded(err) {
+		return err
+	}
+	w.subs.dispatch(changes.events)
+	if c != nil {
+		c.events = append(c.events, changes.events...)
+	}
+	return w.wrapRoots(err)
+}
+
+//wrapRoots makes any new roots in err share the same subscribers
+func (w *WatchedRoot) wrapRoots(err error) error {
+	switch e := err.(type) {
+	case ErrNewRoot:
+		return ErrNewRoot{&WatchedRoot{Root: e.NewRoot, subs: w.subs}}
+	case ErrRemovedRoot:
+		for i, r := range e.NewRoots {
+			e.NewRoots[i] = &WatchedRoot{Root: r, subs: w.subs}
+		}
+		return e
+	}
+	return err
+}
+
+func (w *WatchedRoot) unwrap() Root {
+	return w.Root
+}
+
+//rewrap moves the subscribers to root
+func (w *WatchedRoot) rewrap(root Root, ops []txOp, events []Event) (Root, error) {
+	if w.stale {
+		return nil, ErrStaleRoot
+	}
+	return &WatchedRoot{Root: root, subs: w.subs}, nil
+}
+
+//retire sends the events of a committed transaction
+func (w *WatchedRoot) retire(events []Event) {
+	w.stale = true
+	w.subs.dispatch(events)
+}
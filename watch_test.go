@@ -0,0 +1,197 @@
+package iptree_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"iptree"
+)
+
+func TestWatch(t *testing.T) {
+	tree := iptree.Watch(buildStreamTree(t))
+
+	eventString := func(e iptree.Event) string {
+		switch e.Type {
+		case iptree.EventInserted:
+			return fmt.Sprintf("inserted %v=%v", e.IPNet.String(), e.Value)
+		case iptree.EventRemoved:
+			return fmt.Sprintf("removed %v=%v", e.IPNet.String(), e.Value)
+		case iptree.EventValueChanged:
+			return fmt.Sprintf("changed %v=%v (was %v)", e.IPNet.String(), e.Value, e.OldValue)
+		case iptree.EventReparented:
+			return fmt.Sprintf("reparented %v to %v", e.IPNet.String(), e.Parent.String())
+		}
+		return "unknown"
+	}
+
+	//Watch 10.1.0.0/16 with a callback, and 192.168.0.0/16 with a channel
+	var got []string
+	_, ten1, _ := net.ParseCIDR("10.1.0.0/16")
+	cancel := tree.Subscribe(*ten1, func(e iptree.Event) {
+		got = append(got, eventString(e))
+	})
+	_, private, _ := net.ParseCIDR("192.168.0.0/16")
+	ch, cancelChan := tree.SubscribeChan(*private, 10)
+
+	//Insert 10.1.0.0/20, adopting 10.1.1.0/24
+	_, ipnet, _ := net.ParseCIDR("10.1.0.0/20")
+	if err := tree.Insert(*ipnet, "10.1.0.0/20"); err != nil {
+		t.Error(err)
+	}
+	//Overwrite it
+	if err := tree.Insert(*ipnet, "twenty"); err != nil {
+		t.Error(err)
+	}
+	//Outside the subscription, nothing is sent
+	_, ipnet2, _ := net.ParseCIDR("10.2.1.0/24")
+	if err := tree.Insert(*ipnet2, "10.2.1.0/24"); err != nil {
+		t.Error(err)
+	}
+	//Remove it again with Update, moving 10.1.1.0/24 back
+	err := tree.Update(*ipnet, func(interface{}, bool) (interface{}, bool) {
+		return nil, false
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	//Remove every /25
+	err = tree.RemoveIf(func(ipnet net.IPNet, value interface{}) bool {
+		ones, _ := ipnet.Mask.Size()
+		return ones == 25
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	//Remove the whole subscribed subtree
+	if err := tree.RemoveSubtree(*ten1); err != nil {
+		t.Error(err)
+	}
+
+	want := []string{
+		"inserted 10.1.0.0/20=10.1.0.0/20",
+		"reparented 10.1.1.0/24 to 10.1.0.0/20",
+		"changed 10.1.0.0/20=twenty (was 10.1.0.0/20)",
+		"removed 10.1.0.0/20=twenty",
+		"reparented 10.1.1.0/24 to 10.1.0.0/16",
+		"removed 10.1.1.128/25=10.1.1.128/25",
+		"removed 10.1.0.0/16=10.1.0.0/16",
+		"removed 10.1.1.0/24=10.1.1.0/24",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q", got)
+	}
+
+	//After cancel, nothing is sent
+	cancel()
+	got = nil
+	if err := tree.Insert(*ten1, "again"); err != nil || len(got) != 0 {
+		t.Errorf("Error: %v, got: %q", err, got)
+	}
+
+	//Channel subscription
+	_, ipnet, _ = net.ParseCIDR("192.168.1.0/24")
+	if err := tree.Insert(*ipnet, "192.168.1.0/24"); err != nil {
+		t.Error(err)
+	}
+	if e := eventString(<-ch); e != "inserted 192.168.1.0/24=192.168.1.0/24" {
+		t.Error(e)
+	}
+	cancelChan()
+	if _, ok := <-ch; ok {
+		t.Error("Channel not closed")
+	}
+
+	//New roots are watched too
+	got = nil
+	tree.Subscribe(net.IPNet{IP: []byte{0, 0, 0, 0}, Mask: []byte{0, 0, 0, 0}}, func(e iptree.Event) {
+		got = append(got, eventString(e))
+	})
+	err = tree.Remove(net.IPNet{IP: []byte{0, 0, 0, 0}, Mask: []byte{0, 0, 0, 0}})
+	rr, ok := err.(iptree.ErrRemovedRoot)
+	if !ok || len(rr.NewRoots) != 2 {
+		t.Fatal(err)
+	}
+	if err := rr.NewRoots[0].Insert(*ipnet2, "changed"); err != nil {
+		t.Error(err)
+	}
+	if len(got) != 4 || got[3] != "changed 10.2.1.0/24=changed (was 10.2.1.0/24)" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestWatchRemoveIf(t *testing.T) {
+	//Events come from the tree inside the TTLRoot, reported as it changes
+	tree := iptree.Watch(iptree.WithTTL(buildStreamTree(t), nil, nil))
+	var got []string
+	tree.Subscribe(net.IPNet{IP: []byte{0, 0, 0, 0}, Mask: []byte{0, 0, 0, 0}}, func(e iptree.Event) {
+		got = append(got, fmt.Sprintf("%v %v %v", e.Type, e.IPNet.String(), e.Parent.String()))
+	})
+
+	//Remove 10.0.0.0/8 and 10.1.0.0/16, moving what is left under root
+	err := tree.RemoveIf(func(ipnet net.IPNet, value interface{}) bool {
+		return value == "10.0.0.0/8" || value == "10.1.0.0/16"
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	want := []string{
+		fmt.Sprint(iptree.EventRemoved, " 10.0.0.0/8 <nil>"),
+		fmt.Sprint(iptree.EventRemoved, " 10.1.0.0/16 <nil>"),
+		fmt.Sprint(iptree.EventReparented, " 10.1.1.0/24 0.0.0.0/0"),
+		fmt.Sprint(iptree.EventReparented, " 10.2.0.0/16 0.0.0.0/0"),
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q", got)
+	}
+
+	//Prune reports every element it drops
+	got = nil
+	if err := tree.Prune(1); err != nil {
+		t.Error(err)
+	}
+	want = []string{
+		fmt.Sprint(iptree.EventRemoved, " 10.1.1.128/25 <nil>"),
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestWatchTx(t *testing.T) {
+	tree := iptree.Watch(buildStreamTree(t))
+	var got []string
+	tree.Subscribe(net.IPNet{IP: []byte{0, 0, 0, 0}, Mask: []byte{0, 0, 0, 0}}, func(e iptree.Event) {
+		got = append(got, fmt.Sprintf("%v %v", e.Type, e.IPNet.String()))
+	})
+
+	//Events are sent once the transaction commits
+	tx := iptree.Begin(tree)
+	_, ipnet, _ := net.ParseCIDR("10.3.0.0/16")
+	tx.Insert(*ipnet, "10.3.0.0/16")
+	_, ten2, _ := net.ParseCIDR("10.2.0.0/16")
+	tx.Remove(*ten2)
+	if len(got) != 0 {
+		t.Errorf("got %q", got)
+	}
+	committed, err := tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		fmt.Sprint(iptree.EventInserted, " 10.3.0.0/16"),
+		fmt.Sprint(iptree.EventRemoved, " 10.2.0.0/16"),
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q", got)
+	}
+
+	//The subscribers moved to the committed root
+	got = nil
+	if err := tree.Insert(*ipnet, "stale"); err != iptree.ErrStaleRoot {
+		t.Error(err)
+	}
+	if err := committed.Insert(*ipnet, "changed"); err != nil || len(got) != 1 {
+		t.Errorf("Error: %v, got: %q", err, got)
+	}
+}